@@ -0,0 +1,29 @@
+package main
+
+import "time"
+
+type adaptivePollingConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	MinInterval time.Duration `yaml:"min_interval"`
+	MaxInterval time.Duration `yaml:"max_interval"`
+}
+
+// adaptiveInterval returns how long to wait before probing an account again.
+// The interval shrinks as the remaining pulls run low or are consumed faster,
+// and grows to the maximum when the account is full, idle or just refilled.
+func adaptiveInterval(config adaptivePollingConfig, l limits, estimate consumptionEstimate) time.Duration {
+	if l.limit <= 0 || l.remaining >= l.limit || estimate.refilled {
+		return config.MaxInterval
+	}
+	if estimate.samples > 1 && !estimate.exhausting {
+		return config.MaxInterval
+	}
+
+	ratio := float64(l.remaining) / float64(l.limit)
+	interval := config.MinInterval + time.Duration(float64(config.MaxInterval-config.MinInterval)*ratio)
+	// Probe at least a few times before the pulls are expected to run out.
+	if estimate.exhausting {
+		interval = min(interval, time.Duration(estimate.exhaustionSeconds/4*float64(time.Second)))
+	}
+	return max(config.MinInterval, min(config.MaxInterval, interval))
+}
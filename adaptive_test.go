@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveInterval(t *testing.T) {
+	config := adaptivePollingConfig{Enabled: true, MinInterval: time.Minute, MaxInterval: 11 * time.Minute}
+	tests := []struct {
+		name     string
+		limits   limits
+		estimate consumptionEstimate
+		want     time.Duration
+	}{
+		{
+			name:     "full account",
+			limits:   limits{limit: 100, remaining: 100},
+			estimate: consumptionEstimate{samples: 3},
+			want:     11 * time.Minute,
+		},
+		{
+			name:     "idle account",
+			limits:   limits{limit: 100, remaining: 10},
+			estimate: consumptionEstimate{samples: 3},
+			want:     11 * time.Minute,
+		},
+		{
+			name:     "just refilled",
+			limits:   limits{limit: 100, remaining: 90},
+			estimate: consumptionEstimate{samples: 1, refilled: true},
+			want:     11 * time.Minute,
+		},
+		{
+			name:     "first reading",
+			limits:   limits{limit: 100, remaining: 50},
+			estimate: consumptionEstimate{samples: 1},
+			want:     6 * time.Minute,
+		},
+		{
+			name:     "slow consumption",
+			limits:   limits{limit: 100, remaining: 80},
+			estimate: consumptionEstimate{samples: 3, exhausting: true, exhaustionSeconds: 36000},
+			want:     9 * time.Minute,
+		},
+		{
+			name:     "close to exhaustion",
+			limits:   limits{limit: 100, remaining: 80},
+			estimate: consumptionEstimate{samples: 3, exhausting: true, exhaustionSeconds: 600},
+			want:     150 * time.Second,
+		},
+		{
+			name:     "about to run out",
+			limits:   limits{limit: 100, remaining: 2},
+			estimate: consumptionEstimate{samples: 3, exhausting: true, exhaustionSeconds: 30},
+			want:     time.Minute,
+		},
+		{
+			name:     "unknown limit",
+			limits:   limits{},
+			estimate: consumptionEstimate{samples: 1},
+			want:     11 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := adaptiveInterval(config, tt.limits, tt.estimate); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSchedulerReschedulesOnIntervalChange(t *testing.T) {
+	newFakeDockerHub(t, "100;w=21600", "42;w=21600")
+	config := configuration{
+		Credentials:    []credentials{{Username: "adaptive", Password: "password"}},
+		UpdateInterval: time.Hour,
+		Timeout:        time.Second,
+		Scheduler:      schedulerConfig{Workers: 1, Jitter: time.Nanosecond},
+	}
+
+	var mutex sync.Mutex
+	probes := 0
+	s := newScheduler(config, func(credentials, limits, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		probes++
+	}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.run(ctx)
+
+	waitFor(t, time.Second, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return probes == 1
+	})
+	s.entries[0].setInterval(100 * time.Millisecond)
+	waitFor(t, time.Second, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return probes >= 3
+	})
+}
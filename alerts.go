@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type alertsConfig struct {
+	Webhooks         []webhookConfig `yaml:"webhooks"`
+	Rules            []alertRule     `yaml:"rules"`
+	RenotifyInterval time.Duration   `yaml:"renotify_interval"`
+}
+
+type webhookConfig struct {
+	URL string `yaml:"url"`
+	// Format is one of json (default), slack or teams.
+	Format   string            `yaml:"format"`
+	Template string            `yaml:"template"`
+	Headers  map[string]string `yaml:"headers"`
+}
+
+// alertRule holds the thresholds for an account, or for every account when
+// Account is empty. A zero threshold is disabled.
+type alertRule struct {
+	Account               string  `yaml:"account"`
+	RemainingBelow        int     `yaml:"remaining_below"`
+	RemainingPercentBelow float64 `yaml:"remaining_percent_below"`
+	ConsecutiveFailures   int     `yaml:"consecutive_failures"`
+}
+
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// alertEvent is the data available to webhook templates.
+type alertEvent struct {
+	Status              string    `json:"status"`
+	Account             string    `json:"account"`
+	Registry            string    `json:"registry"`
+	Condition           string    `json:"condition"`
+	Threshold           float64   `json:"threshold"`
+	Limit               int       `json:"limit"`
+	Remaining           int       `json:"remaining"`
+	RemainingPercent    float64   `json:"remaining_percent"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Message             string    `json:"message"`
+	Time                time.Time `json:"time"`
+}
+
+// alertState is the state of an alert for a single webhook. notified is the
+// status of the last notification the webhook accepted, and sending is set
+// while a notification is queued or being sent.
+type alertState struct {
+	notified     string
+	lastNotified time.Time
+	sending      bool
+}
+
+// alertDelivery is a notification queued for a webhook.
+type alertDelivery struct {
+	key   string
+	hook  webhook
+	event alertEvent
+}
+
+type webhook struct {
+	config   webhookConfig
+	template *template.Template
+}
+
+// alerter evaluates the alert rules after every collection and notifies the
+// webhooks when a threshold is crossed or recovers. Notifications for alerts
+// that keep firing are repeated every renotify interval. Notifications are sent
+// in the background so slow webhooks don't hold up the collections, and the ones
+// a webhook rejects are sent again after the next collection. A nil alerter
+// does nothing.
+type alerter struct {
+	rules            []alertRule
+	webhooks         []webhook
+	renotifyInterval time.Duration
+	anonymousAlias   string
+	client           *http.Client
+	deliveries       chan alertDelivery
+	pending          sync.WaitGroup
+
+	mutex  sync.Mutex
+	states map[string]*alertState
+	// failures counts the consecutive failed collections of every account.
+	failures map[string]int
+	// accounts remembers the account of every credential, since anonymous
+	// ones are named after the source of their last successful collection.
+	accounts map[credentials]string
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+var defaultWebhookTemplates = map[string]string{
+	"json":  `{{ json . }}`,
+	"slack": `{"text": {{ json .Message }}}`,
+	"teams": `{"@type": "MessageCard", "@context": "https://schema.org/extensions", "summary": {{ json .Message }}, "text": {{ json .Message }}}`,
+}
+
+func newAlerter(config configuration) (*alerter, error) {
+	if len(config.Alerts.Webhooks) == 0 {
+		return nil, nil
+	}
+	a := &alerter{
+		rules:            config.Alerts.Rules,
+		renotifyInterval: config.Alerts.RenotifyInterval,
+		anonymousAlias:   config.AnonymousAlias,
+		client:           &http.Client{Timeout: config.Timeout},
+		deliveries:       make(chan alertDelivery, 100),
+		states:           map[string]*alertState{},
+		failures:         map[string]int{},
+		accounts:         map[credentials]string{},
+	}
+	for i, webhookSettings := range config.Alerts.Webhooks {
+		format := webhookSettings.Format
+		if format == "" {
+			format = "json"
+		}
+		text := webhookSettings.Template
+		if text == "" {
+			var ok bool
+			text, ok = defaultWebhookTemplates[format]
+			if !ok {
+				return nil, fmt.Errorf("unsupported webhook format %q", format)
+			}
+		}
+		parsed, err := template.New(fmt.Sprintf("webhook%d", i)).Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for webhook %s: %w", webhookSettings.URL, err)
+		}
+		a.webhooks = append(a.webhooks, webhook{config: webhookSettings, template: parsed})
+	}
+	return a, nil
+}
+
+// start sends the queued notifications in the background.
+func (a *alerter) start() {
+	if a == nil {
+		return
+	}
+	go func() {
+		for delivery := range a.deliveries {
+			a.deliver(delivery)
+		}
+	}()
+}
+
+// wait blocks until every queued notification has been sent.
+func (a *alerter) wait() {
+	if a == nil {
+		return
+	}
+	a.pending.Wait()
+}
+
+// observe evaluates the rules of the account of a credential with the result of
+// a collection. Thresholds on the remaining pulls are left untouched when the
+// collection failed.
+func (a *alerter) observe(credential credentials, l limits, collectErr error, now time.Time) {
+	if a == nil {
+		return
+	}
+	registry := credential.registry()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	account, known := a.accounts[credential]
+	if collectErr == nil || !known {
+		account = accountName(credential, a.anonymousAlias, l.source)
+		a.accounts[credential] = account
+	}
+	key := accountKey(registry, account)
+	if collectErr != nil {
+		a.failures[key]++
+	} else {
+		a.failures[key] = 0
+	}
+	failures := a.failures[key]
+
+	for i, rule := range a.rules {
+		if rule.Account != "" && rule.Account != account {
+			continue
+		}
+		base := alertEvent{
+			Account:             account,
+			Registry:            registry,
+			Limit:               l.limit,
+			Remaining:           l.remaining,
+			RemainingPercent:    remainingPercent(l),
+			ConsecutiveFailures: failures,
+			Time:                now,
+		}
+		if rule.ConsecutiveFailures > 0 {
+			event := base
+			event.Condition = "consecutive_failures"
+			event.Threshold = float64(rule.ConsecutiveFailures)
+			a.transition(i, event, failures >= rule.ConsecutiveFailures, now)
+		}
+		if collectErr != nil || l.unlimited {
+			continue
+		}
+		if rule.RemainingBelow > 0 {
+			event := base
+			event.Condition = "remaining"
+			event.Threshold = float64(rule.RemainingBelow)
+			a.transition(i, event, l.remaining < rule.RemainingBelow, now)
+		}
+		if rule.RemainingPercentBelow > 0 && l.limit > 0 {
+			event := base
+			event.Condition = "remaining_percent"
+			event.Threshold = rule.RemainingPercentBelow
+			a.transition(i, event, base.RemainingPercent < rule.RemainingPercentBelow, now)
+		}
+	}
+}
+
+// transition queues the notification of an alert for every webhook whose last
+// accepted notification doesn't match the alert anymore. Must be called with
+// the mutex held.
+func (a *alerter) transition(rule int, event alertEvent, firing bool, now time.Time) {
+	for i, hook := range a.webhooks {
+		key := fmt.Sprintf("%d/%s/%s/%d", rule, event.Condition, accountKey(event.Registry, event.Account), i)
+		current, ok := a.states[key]
+		if !ok {
+			current = &alertState{}
+			a.states[key] = current
+		}
+		if current.sending {
+			continue
+		}
+
+		switch {
+		case firing && current.notified != alertFiring:
+			event.Status = alertFiring
+		case firing && a.renotifyInterval > 0 && now.Sub(current.lastNotified) >= a.renotifyInterval:
+			event.Status = alertFiring
+		case !firing && current.notified == alertFiring:
+			event.Status = alertResolved
+		default:
+			continue
+		}
+		event.Message = alertMessage(event)
+
+		a.pending.Add(1)
+		select {
+		case a.deliveries <- alertDelivery{key: key, hook: hook, event: event}:
+			current.sending = true
+		default:
+			a.pending.Done()
+			log.WithFields(log.Fields{
+				"account":   event.Account,
+				"registry":  event.Registry,
+				"condition": event.Condition,
+			}).Warn("Too many pending alerts, the notification will be retried after the next collection")
+		}
+	}
+}
+
+func remainingPercent(l limits) float64 {
+	if l.limit == 0 {
+		return 0
+	}
+	return float64(l.remaining) / float64(l.limit) * 100
+}
+
+func alertMessage(event alertEvent) string {
+	var description string
+	switch event.Condition {
+	case "consecutive_failures":
+		description = fmt.Sprintf("failed to collect limits %d times in a row (threshold %.0f)", event.ConsecutiveFailures, event.Threshold)
+	case "remaining":
+		description = fmt.Sprintf("has %d pulls remaining (threshold %.0f)", event.Remaining, event.Threshold)
+	case "remaining_percent":
+		description = fmt.Sprintf("has %.1f%% of its %d pulls remaining (threshold %.1f%%)", event.RemainingPercent, event.Limit, event.Threshold)
+	}
+	if event.Status == alertResolved {
+		return fmt.Sprintf("[RESOLVED] Account %s %s", event.Account, description)
+	}
+	return fmt.Sprintf("[FIRING] Account %s %s", event.Account, description)
+}
+
+// deliver sends a queued notification and records it as notified only when the
+// webhook accepted it.
+func (a *alerter) deliver(delivery alertDelivery) {
+	defer a.pending.Done()
+	err := a.post(delivery.hook, delivery.event)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"account":   delivery.event.Account,
+			"registry":  delivery.event.Registry,
+			"condition": delivery.event.Condition,
+		}).Errorf("Failed to send alert to webhook, it will be retried after the next collection: %v", err)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	current := a.states[delivery.key]
+	current.sending = false
+	if err == nil {
+		current.notified = delivery.event.Status
+		current.lastNotified = delivery.event.Time
+	}
+}
+
+func (a *alerter) post(hook webhook, event alertEvent) error {
+	var body bytes.Buffer
+	if err := hook.template.Execute(&body, event); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", hook.config.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range hook.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Errorf("Error closing response body: %v", err)
+		}
+	}(resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeWebhookReceiver struct {
+	mutex  sync.Mutex
+	bodies []string
+	// failures is the number of requests to reject before accepting them.
+	failures int
+}
+
+func (f *fakeWebhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	f.bodies = append(f.bodies, string(body))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeWebhookReceiver) received() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.bodies...)
+}
+
+func newTestAlerter(t *testing.T, alerts alertsConfig) (*alerter, *fakeWebhookReceiver) {
+	t.Helper()
+	receiver := &fakeWebhookReceiver{}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	for i := range alerts.Webhooks {
+		alerts.Webhooks[i].URL = server.URL
+	}
+	a, err := newAlerter(configuration{Timeout: time.Second, Alerts: alerts})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	a.start()
+	return a, receiver
+}
+
+// observe evaluates the result of a collection and waits for its notifications.
+func observe(a *alerter, credential credentials, l limits, collectErr error, now time.Time) {
+	a.observe(credential, l, collectErr, now)
+	a.wait()
+}
+
+func TestAlerterRemainingThreshold(t *testing.T) {
+	a, receiver := newTestAlerter(t, alertsConfig{
+		Webhooks: []webhookConfig{{}},
+		Rules:    []alertRule{{Account: "user1", RemainingBelow: 10}},
+	})
+	now := time.Unix(1700000000, 0)
+
+	observe(a, credentials{Username: "user1"}, limits{unlimited: true}, nil, now)
+	observe(a, credentials{Username: "user1"}, limits{limit: 100, remaining: 50}, nil, now)
+	observe(a, credentials{Username: "user1"}, limits{limit: 100, remaining: 5}, nil, now)
+	observe(a, credentials{Username: "user1"}, limits{limit: 100, remaining: 4}, nil, now)
+	observe(a, credentials{Username: "user2"}, limits{limit: 100, remaining: 1}, nil, now)
+	observe(a, credentials{Username: "user1"}, limits{limit: 100, remaining: 100}, nil, now)
+
+	bodies := receiver.received()
+	if len(bodies) != 2 {
+		t.Fatalf("expected a firing and a resolved notification, got %d: %v", len(bodies), bodies)
+	}
+	var firing, resolved alertEvent
+	if err := json.Unmarshal([]byte(bodies[0]), &firing); err != nil {
+		t.Fatalf("expected a JSON body, got %v", err)
+	}
+	if err := json.Unmarshal([]byte(bodies[1]), &resolved); err != nil {
+		t.Fatalf("expected a JSON body, got %v", err)
+	}
+	if firing.Status != alertFiring || firing.Account != "user1" || firing.Remaining != 5 {
+		t.Errorf("unexpected firing event %+v", firing)
+	}
+	if resolved.Status != alertResolved || resolved.Remaining != 100 {
+		t.Errorf("unexpected resolved event %+v", resolved)
+	}
+}
+
+func TestAlerterRenotifies(t *testing.T) {
+	a, receiver := newTestAlerter(t, alertsConfig{
+		Webhooks:         []webhookConfig{{Format: "slack"}},
+		Rules:            []alertRule{{RemainingPercentBelow: 10}},
+		RenotifyInterval: time.Hour,
+	})
+	now := time.Unix(1700000000, 0)
+
+	observe(a, credentials{Username: "user1"}, limits{limit: 100, remaining: 5}, nil, now)
+	observe(a, credentials{Username: "user1"}, limits{limit: 100, remaining: 5}, nil, now.Add(30*time.Minute))
+	observe(a, credentials{Username: "user1"}, limits{limit: 100, remaining: 5}, nil, now.Add(time.Hour))
+
+	bodies := receiver.received()
+	if len(bodies) != 2 {
+		t.Fatalf("expected the alert to be sent again after the renotify interval, got %d notifications", len(bodies))
+	}
+	want := `{"text": "[FIRING] Account user1 has 5.0% of its 100 pulls remaining (threshold 10.0%)"}`
+	if bodies[0] != want {
+		t.Errorf("expected %s, got %s", want, bodies[0])
+	}
+}
+
+func TestAlerterConsecutiveFailures(t *testing.T) {
+	a, receiver := newTestAlerter(t, alertsConfig{
+		Webhooks: []webhookConfig{{Template: `{{ .Status }} {{ .Condition }} {{ .ConsecutiveFailures }}`}},
+		Rules:    []alertRule{{ConsecutiveFailures: 2, RemainingBelow: 10}},
+	})
+	now := time.Unix(1700000000, 0)
+	failure := errors.New("failed")
+
+	observe(a, credentials{Username: "user1"}, limits{}, failure, now)
+	observe(a, credentials{Username: "user1"}, limits{}, failure, now)
+	observe(a, credentials{Username: "user1"}, limits{}, failure, now)
+	observe(a, credentials{Username: "user1"}, limits{limit: 100, remaining: 50}, nil, now)
+
+	bodies := receiver.received()
+	want := []string{"firing consecutive_failures 2", "resolved consecutive_failures 0"}
+	if len(bodies) != len(want) {
+		t.Fatalf("expected %v, got %v", want, bodies)
+	}
+	for i := range want {
+		if bodies[i] != want[i] {
+			t.Errorf("expected %q, got %q", want[i], bodies[i])
+		}
+	}
+}
+
+func TestNewAlerterInvalidFormat(t *testing.T) {
+	_, err := newAlerter(configuration{Alerts: alertsConfig{Webhooks: []webhookConfig{{URL: "http://localhost", Format: "carrier-pigeon"}}}})
+	if err == nil {
+		t.Fatal("expected error for unsupported format, got nil")
+	}
+}
+
+func TestAlerterSeparatesRegistries(t *testing.T) {
+	a, receiver := newTestAlerter(t, alertsConfig{
+		Webhooks: []webhookConfig{{Template: `{{ .Status }} {{ .Registry }} {{ .Account }}`}},
+		Rules:    []alertRule{{RemainingBelow: 10}},
+	})
+	now := time.Unix(1700000000, 0)
+	hub := credentials{Username: "user1"}
+	mirror := credentials{Username: "user1", Registry: "mirror"}
+
+	observe(a, hub, limits{limit: 100, remaining: 5}, nil, now)
+	observe(a, mirror, limits{limit: 100, remaining: 5}, nil, now)
+	observe(a, hub, limits{limit: 100, remaining: 50}, nil, now)
+
+	bodies := receiver.received()
+	want := []string{"firing dockerhub user1", "firing mirror user1", "resolved dockerhub user1"}
+	if len(bodies) != len(want) {
+		t.Fatalf("expected %v, got %v", want, bodies)
+	}
+	for i := range want {
+		if bodies[i] != want[i] {
+			t.Errorf("expected %q, got %q", want[i], bodies[i])
+		}
+	}
+}
+
+func TestAlerterRetriesFailedNotifications(t *testing.T) {
+	a, receiver := newTestAlerter(t, alertsConfig{
+		Webhooks: []webhookConfig{{Template: `{{ .Status }} {{ .Remaining }}`}},
+		Rules:    []alertRule{{RemainingBelow: 10}},
+	})
+	receiver.failures = 1
+	now := time.Unix(1700000000, 0)
+
+	observe(a, credentials{Username: "user1"}, limits{limit: 100, remaining: 5}, nil, now)
+	if bodies := receiver.received(); len(bodies) != 0 {
+		t.Fatalf("expected the rejected notification not to be received, got %v", bodies)
+	}
+	observe(a, credentials{Username: "user1"}, limits{limit: 100, remaining: 4}, nil, now)
+	observe(a, credentials{Username: "user1"}, limits{limit: 100, remaining: 3}, nil, now)
+
+	bodies := receiver.received()
+	if len(bodies) != 1 || bodies[0] != "firing 4" {
+		t.Fatalf("expected the notification to be sent again once, got %v", bodies)
+	}
+}
+
+func TestAlerterNamesAnonymousAccountsAfterTheirSource(t *testing.T) {
+	a, receiver := newTestAlerter(t, alertsConfig{
+		Webhooks: []webhookConfig{{Template: `{{ .Status }} {{ .Condition }} {{ .Account }}`}},
+		Rules:    []alertRule{{ConsecutiveFailures: 1}},
+	})
+	now := time.Unix(1700000000, 0)
+	anonymous := credentials{Anonymous: true}
+
+	observe(a, anonymous, limits{limit: 100, remaining: 50, source: "192.0.2.1"}, nil, now)
+	observe(a, anonymous, limits{}, errors.New("failed"), now)
+	observe(a, anonymous, limits{limit: 100, remaining: 50, source: "192.0.2.1"}, nil, now)
+
+	bodies := receiver.received()
+	want := []string{"firing consecutive_failures 192.0.2.1", "resolved consecutive_failures 192.0.2.1"}
+	if len(bodies) != len(want) {
+		t.Fatalf("expected %v, got %v", want, bodies)
+	}
+	for i := range want {
+		if bodies[i] != want[i] {
+			t.Errorf("expected %q, got %q", want[i], bodies[i])
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type brokerConfig struct {
+	// Tokens are the bearer tokens allowed to lease credentials. The broker is
+	// disabled when there are none.
+	Tokens []string `yaml:"tokens"`
+	// PullsPerLease is how many pulls a lease is expected to consume, unless
+	// the request asks for a different number.
+	PullsPerLease int `yaml:"pulls_per_lease"`
+	// Listen is the address the broker serves leases on, apart from the
+	// metrics server since it hands out passwords.
+	Listen   string `yaml:"listen"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+var (
+	errUnknownPool   = errors.New("unknown pool")
+	errPoolExhausted = errors.New("no account of the pool has pulls left")
+)
+
+// lease is a credential handed out by the broker, and the pulls it is expected
+// to consume.
+type lease struct {
+	pulls int
+	at    time.Time
+}
+
+// credentialBroker hands out the credential of the pool member with the most
+// expected remaining pulls. Every lease is debited from the remaining pulls of
+// its account until the account is probed again, so concurrent jobs are
+// spread across the pool. A nil credentialBroker does nothing.
+type credentialBroker struct {
+	config        brokerConfig
+	server        *http.Server
+	tokens        [][]byte
+	pullsPerLease int
+	pools         map[string][]credentials
+	registries    map[string]registryConfig
+	now           func() time.Time
+
+	mutex  sync.Mutex
+	leases map[string][]lease
+}
+
+func newCredentialBroker(config configuration) (*credentialBroker, error) {
+	if len(config.Broker.Tokens) == 0 {
+		return nil, nil
+	}
+	// Bearer tokens sent in cleartext wouldn't protect the passwords the
+	// broker hands out.
+	if config.Broker.CertFile == "" || config.Broker.KeyFile == "" {
+		return nil, errors.New("broker requires cert_file and key_file")
+	}
+	brokerConfig := config.Broker
+	if brokerConfig.Listen == "" {
+		brokerConfig.Listen = ":9443"
+	}
+	b := &credentialBroker{
+		config:        brokerConfig,
+		pullsPerLease: config.Broker.PullsPerLease,
+		pools:         map[string][]credentials{},
+		registries:    config.Registries,
+		now:           time.Now,
+		leases:        map[string][]lease{},
+	}
+	if b.pullsPerLease == 0 {
+		b.pullsPerLease = 1
+	}
+	for _, token := range config.Broker.Tokens {
+		if token == "" {
+			return nil, errors.New("broker tokens must not be empty")
+		}
+		b.tokens = append(b.tokens, []byte(token))
+	}
+	for _, credential := range config.Credentials {
+		if credential.Pool != "" {
+			b.pools[credential.Pool] = append(b.pools[credential.Pool], credential)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/lease", b.leaseHandler)
+	b.server = &http.Server{
+		Addr:              brokerConfig.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig:         &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	return b, nil
+}
+
+// start serves leases over TLS in the background.
+func (b *credentialBroker) start() {
+	if b == nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"listen": b.config.Listen,
+	}).Info("Starting credential broker")
+	go func() {
+		err := b.server.ListenAndServeTLS(b.config.CertFile, b.config.KeyFile)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start credential broker: %v", err)
+		}
+	}()
+}
+
+// authorized reports whether the request carries one of the broker tokens.
+func (b *credentialBroker) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	for _, allowed := range b.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), allowed) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// lease picks the member of pool with the most expected remaining pulls and
+// debits pulls from it. It returns the credential and the pulls it was
+// expected to have left before the lease.
+func (b *credentialBroker) lease(pool string, pulls int) (credentials, int, error) {
+	members, ok := b.pools[pool]
+	if !ok {
+		return credentials{}, 0, errUnknownPool
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	best, bestRemaining := -1, 0
+	for i, member := range members {
+		remaining, ok := b.expectedRemaining(member)
+		if ok && remaining > 0 && (best < 0 || remaining > bestRemaining) {
+			best, bestRemaining = i, remaining
+		}
+	}
+	if best < 0 {
+		return credentials{}, 0, errPoolExhausted
+	}
+
+	member := members[best]
+	key := accountKey(member.registry(), member.Username)
+	b.leases[key] = append(b.leases[key], lease{pulls: pulls, at: b.now()})
+	return member, bestRemaining, nil
+}
+
+// expectedRemaining returns the remaining pulls of the last reading of the
+// member minus the pulls leased since then. It must be called with the mutex
+// held.
+func (b *credentialBroker) expectedRemaining(member credentials) (int, bool) {
+	key := accountKey(member.registry(), member.Username)
+	reading, ok := state.get(key)
+	if !ok {
+		return 0, false
+	}
+	if reading.Unlimited {
+		return math.MaxInt, true
+	}
+
+	// Leases made before the last probe are already part of its reading.
+	var pending []lease
+	remaining := reading.Remaining
+	for _, l := range b.leases[key] {
+		if l.at.After(reading.CollectedAt) {
+			pending = append(pending, l)
+			remaining -= l.pulls
+		}
+	}
+	b.leases[key] = pending
+	return remaining, true
+}
+
+// leaseHandler serves POST /api/v1/lease?pool=<pool>, optionally with
+// pulls=<expected pulls> and format=docker-config.
+func (b *credentialBroker) leaseHandler(w http.ResponseWriter, r *http.Request) {
+	if !b.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="dockerhub-pull-limit-exporter"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pool := r.URL.Query().Get("pool")
+	if pool == "" {
+		http.Error(w, "pool is required", http.StatusBadRequest)
+		return
+	}
+	pulls := b.pullsPerLease
+	if value := r.URL.Query().Get("pulls"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, fmt.Sprintf("invalid pulls %q", value), http.StatusBadRequest)
+			return
+		}
+		pulls = parsed
+	}
+
+	member, remaining, err := b.lease(pool, pulls)
+	switch {
+	case errors.Is(err, errUnknownPool):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errPoolExhausted):
+		log.WithFields(log.Fields{
+			"pool": pool,
+		}).Warn("No credential to lease, the pool is exhausted")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	leasesCount.WithLabelValues(pool, member.Username).Inc()
+	log.WithFields(log.Fields{
+		"pool":      pool,
+		"username":  member.Username,
+		"remaining": remaining,
+		"pulls":     pulls,
+	}).Info("Leased credential")
+
+	var response any = struct {
+		Pool      string `json:"pool"`
+		Username  string `json:"username"`
+		Password  string `json:"password"`
+		Registry  string `json:"registry"`
+		Remaining int    `json:"expected_remaining"`
+		Pulls     int    `json:"pulls"`
+	}{pool, member.Username, member.Password, member.registry(), remaining, pulls}
+	if r.URL.Query().Get("format") == "docker-config" {
+		auth := base64.StdEncoding.EncodeToString([]byte(member.Username + ":" + member.Password))
+		response = map[string]any{
+			"auths": map[string]any{
+				b.registryHost(member.registry()): map[string]string{"auth": auth},
+			},
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("error responding to request %v", err)
+	}
+}
+
+// registryHost returns the key of the registry in the auths of a Docker
+// config.json.
+func (b *credentialBroker) registryHost(registry string) string {
+	if registry == dockerHubRegistry {
+		return "https://index.docker.io/v1/"
+	}
+	config := b.registries[registry]
+	if parsed, err := url.Parse(config.URL); err == nil && parsed.Host != "" {
+		return parsed.Host
+	}
+	return registry
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestBroker(t *testing.T, members ...credentials) *credentialBroker {
+	t.Helper()
+	b, err := newCredentialBroker(configuration{
+		Credentials: members,
+		Broker:      brokerConfig{Tokens: []string{"secret"}, CertFile: "broker.crt", KeyFile: "broker.key"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return b
+}
+
+func leaseRequest(t *testing.T, b *credentialBroker, method, query, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, "/api/v1/lease?"+query, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	b.leaseHandler(rec, req)
+	return rec
+}
+
+func leasedUsername(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var response struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return response.Username
+}
+
+func TestCredentialBrokerRequiresToken(t *testing.T) {
+	b := newTestBroker(t, credentials{Username: "broker-auth", Password: "pass", Pool: "auth"})
+	for _, token := range []string{"", "wrong"} {
+		rec := leaseRequest(t, b, http.MethodPost, "pool=auth", token)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401 for token %q, got %d", token, rec.Code)
+		}
+	}
+	if rec := leaseRequest(t, b, http.MethodGet, "pool=auth", "secret"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", rec.Code)
+	}
+}
+
+func TestCredentialBrokerSpreadsLeases(t *testing.T) {
+	b := newTestBroker(t,
+		credentials{Username: "broker-a", Password: "pass-a", Pool: "ci"},
+		credentials{Username: "broker-b", Password: "pass-b", Pool: "ci"},
+	)
+	now := time.Unix(1767225600, 0)
+	b.now = func() time.Time { return now }
+	state.record("broker-a", limits{limit: 200, remaining: 10, registry: dockerHubRegistry}, now.Add(-time.Minute))
+	state.record("broker-b", limits{limit: 200, remaining: 8, registry: dockerHubRegistry}, now.Add(-time.Minute))
+
+	// Every lease is debited from the account it was made from, so leases
+	// alternate between both accounts once their expected pulls are even.
+	var leased []string
+	for range 4 {
+		leased = append(leased, leasedUsername(t, leaseRequest(t, b, http.MethodPost, "pool=ci&pulls=2", "secret")))
+	}
+	want := []string{"broker-a", "broker-a", "broker-b", "broker-a"}
+	for i := range want {
+		if leased[i] != want[i] {
+			t.Fatalf("expected leases %v, got %v", want, leased)
+		}
+	}
+
+	// A new reading replaces the leases made before it.
+	state.record("broker-b", limits{limit: 200, remaining: 1, registry: dockerHubRegistry}, now.Add(time.Minute))
+	now = now.Add(2 * time.Minute)
+	if got := leasedUsername(t, leaseRequest(t, b, http.MethodPost, "pool=ci", "secret")); got != "broker-a" {
+		t.Errorf("expected broker-a, got %s", got)
+	}
+	state.record("broker-a", limits{limit: 200, remaining: 0, registry: dockerHubRegistry}, now.Add(time.Minute))
+	if got := leasedUsername(t, leaseRequest(t, b, http.MethodPost, "pool=ci", "secret")); got != "broker-b" {
+		t.Errorf("expected broker-b, got %s", got)
+	}
+	if rec := leaseRequest(t, b, http.MethodPost, "pool=ci", "secret"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 once the pool is exhausted, got %d", rec.Code)
+	}
+}
+
+func TestCredentialBrokerDockerConfig(t *testing.T) {
+	b := newTestBroker(t, credentials{Username: "broker-config", Password: "pass", Pool: "config"})
+	state.record("broker-config", limits{limit: 200, remaining: 10, registry: dockerHubRegistry}, time.Now())
+
+	rec := leaseRequest(t, b, http.MethodPost, "pool=config&format=docker-config", "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("expected the response not to be cached, got %q", got)
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&config); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := base64.StdEncoding.EncodeToString([]byte("broker-config:pass"))
+	if got := config.Auths["https://index.docker.io/v1/"].Auth; got != want {
+		t.Errorf("expected auth %s, got %s", want, got)
+	}
+}
+
+func TestCredentialBrokerUnknownPool(t *testing.T) {
+	b := newTestBroker(t, credentials{Username: "broker-unknown", Password: "pass", Pool: "ci"})
+	if rec := leaseRequest(t, b, http.MethodPost, "pool=release", "secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rec.Code)
+	}
+	if rec := leaseRequest(t, b, http.MethodPost, "", "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", rec.Code)
+	}
+}
+
+func TestCredentialBrokerDisabled(t *testing.T) {
+	b, err := newCredentialBroker(configuration{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if b != nil {
+		t.Fatal("expected no broker without tokens")
+	}
+	b.start()
+}
+
+func TestCredentialBrokerRequiresTLS(t *testing.T) {
+	if _, err := newCredentialBroker(configuration{Broker: brokerConfig{Tokens: []string{"secret"}}}); err == nil {
+		t.Fatal("expected error without cert_file and key_file, got nil")
+	}
+}
+
+func TestCredentialBrokerServesOverTLS(t *testing.T) {
+	b := newTestBroker(t, credentials{Username: "broker-tls", Password: "pass", Pool: "tls"})
+	state.record("broker-tls", limits{limit: 200, remaining: 10, registry: dockerHubRegistry}, time.Now())
+	server := httptest.NewTLSServer(b.server.Handler)
+	t.Cleanup(server.Close)
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/api/v1/lease?pool=tls", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+}
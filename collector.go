@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// limitsCollector probes Docker Hub while Prometheus scrapes instead of relying
+// on background tickers. Results are cached for cacheTTL and concurrent scrapes
+// share the same in-flight probe, so several Prometheus replicas don't multiply
+// the requests sent to Docker Hub.
+type limitsCollector struct {
+	credentials    []credentials
+	timeout        time.Duration
+	anonymousAlias string
+	cacheTTL       time.Duration
+
+	group singleflight.Group
+	mutex sync.Mutex
+	cache map[string]cachedLimits
+
+	limitDesc           *prometheus.Desc
+	remainingDesc       *prometheus.Desc
+	limitWindowDesc     *prometheus.Desc
+	remainingWindowDesc *prometheus.Desc
+	lastSuccessDesc     *prometheus.Desc
+	consumptionDesc     *prometheus.Desc
+	exhaustionDesc      *prometheus.Desc
+	resetDesc           *prometheus.Desc
+	windowLimitDesc     *prometheus.Desc
+	windowRemainingDesc *prometheus.Desc
+	unlimitedDesc       *prometheus.Desc
+}
+
+// cachedLimits is the last known reading of a credential and the result of its
+// latest probe. A failed probe keeps the previous reading, which is zero when
+// none was ever collected or restored from the state file.
+type cachedLimits struct {
+	limits      limits
+	estimate    consumptionEstimate
+	collectedAt time.Time
+	checkedAt   time.Time
+	err         error
+}
+
+func newLimitsCollector(config configuration) *limitsCollector {
+	cacheTTL := config.CacheTTL
+	if cacheTTL == 0 {
+		cacheTTL = config.UpdateInterval
+	}
+	c := &limitsCollector{
+		credentials:         config.Credentials,
+		timeout:             config.Timeout,
+		anonymousAlias:      config.AnonymousAlias,
+		cacheTTL:            cacheTTL,
+		cache:               map[string]cachedLimits{},
+		limitDesc:           newDesc(pullLimitOpts, accountLabels),
+		remainingDesc:       newDesc(pullRemainingOpts, accountLabels),
+		limitWindowDesc:     newDesc(limitWindowSecondsOpts, accountLabels),
+		remainingWindowDesc: newDesc(remainingWindowSecondsOpts, accountLabels),
+		lastSuccessDesc:     newDesc(lastSuccessTimestampOpts, accountLabels),
+		consumptionDesc:     newDesc(consumptionPerHourOpts, accountLabels),
+		exhaustionDesc:      newDesc(estimatedExhaustionSecondsOpts, accountLabels),
+		resetDesc:           newDesc(estimatedResetTimestampOpts, accountLabels),
+		windowLimitDesc:     newDesc(windowLimitOpts, windowLabels),
+		windowRemainingDesc: newDesc(windowRemainingOpts, windowLabels),
+		unlimitedDesc: prometheus.NewDesc(fmt.Sprintf("%sunlimited", prefix), "Whether the account has no pull rate limit",
+			[]string{"account", "registry"}, nil),
+	}
+	return c
+}
+
+// restore seeds the cache with the readings restored from the state file, so
+// they are exposed until the credentials are probed again.
+func (c *limitsCollector) restore(accounts []accountState) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, credential := range c.credentials {
+		if reading, ok := restoredReading(accounts, credential, c.anonymousAlias); ok {
+			c.cache[credentialKey(credential)] = cachedLimits{
+				limits:      reading.limits(),
+				collectedAt: reading.CollectedAt,
+				checkedAt:   reading.CollectedAt,
+			}
+		}
+	}
+}
+
+// restoredReading returns the reading of a credential among the restored ones.
+// Anonymous accounts without an alias are named after their source, so their
+// reading is only found when the registry has a single one.
+func restoredReading(accounts []accountState, credential credentials, anonymousAlias string) (accountState, bool) {
+	registry := credential.registry()
+	var found []accountState
+	for _, reading := range accounts {
+		if reading.registry() != registry {
+			continue
+		}
+		if !credential.Anonymous || anonymousAlias != "" {
+			if reading.Account == accountName(credential, anonymousAlias, "") {
+				return reading, true
+			}
+		} else if reading.Account == reading.Source && net.ParseIP(reading.Source) != nil {
+			found = append(found, reading)
+		}
+	}
+	if len(found) != 1 {
+		return accountState{}, false
+	}
+	return found[0], true
+}
+
+func newDesc(opts prometheus.GaugeOpts, labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(opts.Name, opts.Help, labels, nil)
+}
+
+func (c *limitsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.limitDesc
+	ch <- c.remainingDesc
+	ch <- c.limitWindowDesc
+	ch <- c.remainingWindowDesc
+	ch <- c.lastSuccessDesc
+	ch <- c.consumptionDesc
+	ch <- c.exhaustionDesc
+	ch <- c.resetDesc
+	ch <- c.windowLimitDesc
+	ch <- c.windowRemainingDesc
+	ch <- c.unlimitedDesc
+}
+
+func (c *limitsCollector) Collect(ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	for _, credential := range c.credentials {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cached, _ := c.limits(credential)
+			if cached.collectedAt.IsZero() {
+				return
+			}
+			l, estimate := cached.limits, cached.estimate
+			username := accountName(credential, c.anonymousAlias, l.source)
+			if l.unlimited {
+				ch <- prometheus.MustNewConstMetric(c.unlimitedDesc, prometheus.GaugeValue, 1, username, l.registry)
+				return
+			}
+			ch <- prometheus.MustNewConstMetric(c.unlimitedDesc, prometheus.GaugeValue, 0, username, l.registry)
+			ch <- prometheus.MustNewConstMetric(c.limitDesc, prometheus.GaugeValue, float64(l.limit), username, l.source, l.registry, l.policy)
+			ch <- prometheus.MustNewConstMetric(c.remainingDesc, prometheus.GaugeValue, float64(l.remaining), username, l.source, l.registry, l.policy)
+			ch <- prometheus.MustNewConstMetric(c.limitWindowDesc, prometheus.GaugeValue, float64(l.limitWindow), username, l.source, l.registry, l.policy)
+			ch <- prometheus.MustNewConstMetric(c.remainingWindowDesc, prometheus.GaugeValue, float64(l.remainingWindow), username, l.source, l.registry, l.policy)
+			ch <- prometheus.MustNewConstMetric(c.lastSuccessDesc, prometheus.GaugeValue, timestampSeconds(cached.collectedAt), username, l.source, l.registry, l.policy)
+			// Readings restored from the state file have no estimate until the
+			// next probe.
+			if estimate.samples > 0 {
+				ch <- prometheus.MustNewConstMetric(c.consumptionDesc, prometheus.GaugeValue, estimate.pullsPerHour, username, l.source, l.registry, l.policy)
+				ch <- prometheus.MustNewConstMetric(c.resetDesc, prometheus.GaugeValue, estimate.resetTimestamp, username, l.source, l.registry, l.policy)
+			}
+			if estimate.exhausting {
+				ch <- prometheus.MustNewConstMetric(c.exhaustionDesc, prometheus.GaugeValue, estimate.exhaustionSeconds, username, l.source, l.registry, l.policy)
+			}
+			for _, w := range l.windows {
+				window := strconv.Itoa(w.window)
+				ch <- prometheus.MustNewConstMetric(c.windowLimitDesc, prometheus.GaugeValue, float64(w.limit), username, l.source, l.registry, w.policy, window)
+				ch <- prometheus.MustNewConstMetric(c.windowRemainingDesc, prometheus.GaugeValue, float64(w.remaining), username, l.source, l.registry, w.policy, window)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// limits returns the cached limits for a credential, probing Docker Hub when
+// the latest probe is older than cacheTTL. Failed probes are cached too, so a
+// failure is recorded once and not retried on every scrape.
+func (c *limitsCollector) limits(credential credentials) (cachedLimits, error) {
+	key := credentialKey(credential)
+
+	c.mutex.Lock()
+	cached, ok := c.cache[key]
+	c.mutex.Unlock()
+	if ok && time.Since(cached.checkedAt) < c.cacheTTL {
+		return cached, cached.err
+	}
+
+	result, err, _ := c.group.Do(key, func() (interface{}, error) {
+		log.WithFields(log.Fields{
+			"username": credential.Username,
+		}).Debug("Collecting metrics")
+		l, err := probeCredential(credential, c.timeout)
+		now := time.Now()
+		if err != nil {
+			recordCollectError(credential, err)
+			c.mutex.Lock()
+			failed := c.cache[key]
+			failed.checkedAt = now
+			failed.err = err
+			c.cache[key] = failed
+			c.mutex.Unlock()
+			return failed, err
+		}
+		username := accountName(credential, c.anonymousAlias, l.source)
+		state.record(username, l, now)
+		cached := cachedLimits{
+			limits:      l,
+			collectedAt: now,
+			checkedAt:   now,
+		}
+		if !l.unlimited {
+			cached.estimate = consumption.observe(accountKey(l.registry, username), l, now)
+		}
+		c.mutex.Lock()
+		c.cache[key] = cached
+		c.mutex.Unlock()
+		return cached, nil
+	})
+	return result.(cachedLimits), err
+}
+
+// credentialKey identifies a credential independently of the label it is
+// reported under.
+func credentialKey(credential credentials) string {
+	if credential.Anonymous {
+		return accountKey(credential.registry(), "anonymous")
+	}
+	return accountKey(credential.registry(), credential.Username)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLimitsCollector(t *testing.T) {
+	newFakeDockerHub(t, "100;w=21600", "42;w=21600")
+	collector := newLimitsCollector(configuration{
+		Credentials: []credentials{
+			{Username: "scraped-user", Password: "password"},
+			{Anonymous: true},
+		},
+		AnonymousAlias: "scraped-alias",
+		Timeout:        time.Second,
+		UpdateInterval: time.Minute,
+	})
+
+	expected := `
+# HELP dockerhub_pull_remaining_total The remaining DockerHub pulls
+# TYPE dockerhub_pull_remaining_total gauge
+dockerhub_pull_remaining_total{account="scraped-alias",policy="",registry="dockerhub",source="192.0.2.1"} 42
+dockerhub_pull_remaining_total{account="scraped-user",policy="",registry="dockerhub",source="6f3b2c1a-0d4e-4f5a-9b8c-7d6e5f4a3b2c"} 42
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "dockerhub_pull_remaining_total"); err != nil {
+		t.Fatal(err)
+	}
+	if count := testutil.CollectAndCount(collector); count != 20 {
+		t.Fatalf("expected 20 metrics, got %d", count)
+	}
+}
+
+func TestLimitsCollectorCachesResults(t *testing.T) {
+	hub := newFakeDockerHub(t, "100;w=21600", "42;w=21600")
+	collector := newLimitsCollector(configuration{
+		Credentials: []credentials{{Username: "user1", Password: "password1"}},
+		Timeout:     time.Second,
+		CacheTTL:    time.Minute,
+	})
+
+	testutil.CollectAndCount(collector)
+	testutil.CollectAndCount(collector)
+	if probes := hub.probes.Load(); probes != 1 {
+		t.Fatalf("expected cached results to be reused, got %d probes", probes)
+	}
+
+	collector.cacheTTL = 0
+	testutil.CollectAndCount(collector)
+	if probes := hub.probes.Load(); probes != 2 {
+		t.Fatalf("expected expired results to be refreshed, got %d probes", probes)
+	}
+}
+
+func TestLimitsCollectorCachesFailures(t *testing.T) {
+	hub := newFakeDockerHub(t, "100;w=21600", "42;w=21600")
+	hub.anonymousFallback = true
+	hub.delay = 50 * time.Millisecond
+	collector := newLimitsCollector(configuration{
+		Credentials: []credentials{{Username: "cached-failure", Password: "password"}},
+		Timeout:     time.Second,
+		CacheTTL:    time.Minute,
+	})
+	failures := anonymousFallbackCount.WithLabelValues("cached-failure", "dockerhub")
+	before := testutil.ToFloat64(failures)
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testutil.CollectAndCount(collector)
+		}()
+	}
+	wg.Wait()
+	testutil.CollectAndCount(collector)
+
+	if probes := hub.probes.Load(); probes != 1 {
+		t.Errorf("expected the failure to be cached, got %d probes", probes)
+	}
+	if got := testutil.ToFloat64(failures) - before; got != 1 {
+		t.Errorf("expected the failure to be recorded once, got %f", got)
+	}
+}
+
+func TestLimitsCollectorCoalescesConcurrentScrapes(t *testing.T) {
+	hub := newFakeDockerHub(t, "100;w=21600", "42;w=21600")
+	hub.delay = 100 * time.Millisecond
+	collector := newLimitsCollector(configuration{
+		Credentials: []credentials{{Username: "user1", Password: "password1"}},
+		Timeout:     time.Second,
+		CacheTTL:    time.Minute,
+	})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := registry.Gather(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if probes := hub.probes.Load(); probes != 1 {
+		t.Fatalf("expected concurrent scrapes to share one probe, got %d probes", probes)
+	}
+}
+
+func TestLimitsCollectorExposesRestoredState(t *testing.T) {
+	hub := newFakeDockerHub(t, "100;w=21600", "42;w=21600")
+	hub.anonymousFallback = true
+	collectedAt := time.Now().Add(-time.Hour)
+	collector := newLimitsCollector(configuration{
+		Credentials: []credentials{{Username: "restored-scrape", Password: "password"}},
+		Timeout:     time.Second,
+		CacheTTL:    time.Minute,
+	})
+	collector.restore([]accountState{{
+		Account:         "restored-scrape",
+		Source:          "6f3b2c1a-0d4e-4f5a-9b8c-7d6e5f4a3b2c",
+		Limit:           100,
+		Remaining:       7,
+		LimitWindow:     21600,
+		RemainingWindow: 21600,
+		Windows:         []windowState{{Policy: "hourly", Window: 3600, Limit: 100, Remaining: 7}},
+		CollectedAt:     collectedAt,
+	}})
+
+	// The restored reading is stale, so the scrape probes again, and keeps
+	// exposing it when the probe fails.
+	expected := `
+# HELP dockerhub_pull_remaining_total The remaining DockerHub pulls
+# TYPE dockerhub_pull_remaining_total gauge
+dockerhub_pull_remaining_total{account="restored-scrape",policy="",registry="dockerhub",source="6f3b2c1a-0d4e-4f5a-9b8c-7d6e5f4a3b2c"} 7
+# HELP dockerhub_pull_window_remaining_total The remaining DockerHub pulls of every policy, by window in seconds
+# TYPE dockerhub_pull_window_remaining_total gauge
+dockerhub_pull_window_remaining_total{account="restored-scrape",policy="hourly",registry="dockerhub",source="6f3b2c1a-0d4e-4f5a-9b8c-7d6e5f4a3b2c",window="3600"} 7
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "dockerhub_pull_remaining_total", "dockerhub_pull_window_remaining_total"); err != nil {
+		t.Fatal(err)
+	}
+	if probes := hub.probes.Load(); probes != 1 {
+		t.Errorf("expected the stale reading to be refreshed, got %d probes", probes)
+	}
+}
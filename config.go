@@ -3,30 +3,111 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type configuration struct {
-	Credentials    []credentials `json:"credentials"`
-	UpdateInterval time.Duration `yaml:"update_interval"`
-	Timeout        time.Duration `yaml:"timeout"`
-	ConfigFiles    []string      `yaml:"config_files"`
-	AllowAnonymous bool          `yaml:"allow_anonymous"`
-	AnonymousAlias string        `yaml:"anonymous_alias"`
+	Credentials       []credentials             `json:"credentials"`
+	UpdateInterval    time.Duration             `yaml:"update_interval"`
+	Timeout           time.Duration             `yaml:"timeout"`
+	ConfigFiles       []string                  `yaml:"config_files"`
+	AllowAnonymous    bool                      `yaml:"allow_anonymous"`
+	AnonymousAlias    string                    `yaml:"anonymous_alias"`
+	ProbeOnly         bool                      `yaml:"probe_only"`
+	Modules           map[string]credentials    `yaml:"modules"`
+	CollectOnScrape   bool                      `yaml:"collect_on_scrape"`
+	CacheTTL          time.Duration             `yaml:"cache_ttl"`
+	StateFile         string                    `yaml:"state_file"`
+	StateSaveInterval time.Duration             `yaml:"state_save_interval"`
+	Pushgateway       pushgatewayConfig         `yaml:"pushgateway"`
+	OTLP              otlpConfig                `yaml:"otlp"`
+	RemoteWrite       remoteWriteConfig         `yaml:"remote_write"`
+	Alerts            alertsConfig              `yaml:"alerts"`
+	LeaderElection    leaderElectionConfig      `yaml:"leader_election"`
+	Scheduler         schedulerConfig           `yaml:"scheduler"`
+	AdaptivePolling   adaptivePollingConfig     `yaml:"adaptive_polling"`
+	Registries        map[string]registryConfig `yaml:"registries"`
+	DockerEvents      dockerEventsConfig        `yaml:"docker_events"`
+	ContainerdEvents  containerdEventsConfig    `yaml:"containerd_events"`
+	KubernetesEvents  kubernetesEventsConfig    `yaml:"kubernetes_events"`
+	Proxy             proxyConfig               `yaml:"proxy"`
+	RegistryLogs      registryLogsConfig        `yaml:"registry_logs"`
+	Broker            brokerConfig              `yaml:"broker"`
+	Pools             map[string]poolConfig     `yaml:"pools"`
+	// NodeName labels the pulls seen by the container runtime, the NODE_NAME
+	// environment variable or the hostname when empty.
+	NodeName string `yaml:"node_name"`
 }
 
 type credentials struct {
 	Username  string `json:"username"`
 	Password  string `json:"password"`
 	Anonymous bool   `json:"anonymous"`
+	// Registry is the name of the registry the credential belongs to, Docker
+	// Hub when empty.
+	Registry string `json:"registry"`
+	// TokenType tells what the password is: password (default), pat for a
+	// Docker Hub personal access token or oat for an organization access token,
+	// whose username is the organization name.
+	TokenType string `json:"token_type" yaml:"token_type"`
+	// Pool is the pool of the credential broker the credential is leased from.
+	Pool string `json:"pool"`
+}
+
+const (
+	tokenTypePassword = "password"
+	tokenTypePAT      = "pat"
+	tokenTypeOAT      = "oat"
+)
+
+// tokenPrefixes are the prefixes Docker Hub gives to each kind of access token.
+var tokenPrefixes = map[string]string{
+	tokenTypePAT: "dckr_pat_",
+	tokenTypeOAT: "dckr_oat_",
 }
 
 func (c credentials) invalid() bool {
 	return (c.Username == "" || c.Password == "") && !c.Anonymous
 }
 
+func (c credentials) tokenType() string {
+	if c.TokenType == "" {
+		return tokenTypePassword
+	}
+	return c.TokenType
+}
+
+// checkTokenType makes sure the token type is known and that Docker Hub access
+// tokens look like the type they are declared as, so a password or a personal
+// token isn't used where an organization token is expected.
+func (c credentials) checkTokenType() error {
+	tokenType := c.tokenType()
+	if tokenType == tokenTypePassword {
+		return nil
+	}
+	prefix, ok := tokenPrefixes[tokenType]
+	if !ok {
+		return fmt.Errorf("unsupported token type %q", tokenType)
+	}
+	if c.Anonymous {
+		return fmt.Errorf("anonymous credentials can't have a token type")
+	}
+	if c.registry() == dockerHubRegistry && !strings.HasPrefix(c.Password, prefix) {
+		return fmt.Errorf("token type %s requires a token starting with %s", tokenType, prefix)
+	}
+	return nil
+}
+
+func (c credentials) registry() string {
+	if c.Registry == "" {
+		return dockerHubRegistry
+	}
+	return c.Registry
+}
+
 func getConfig(configFile string) (configuration, error) {
 	yamlFile, err := os.ReadFile(configFile)
 	if err != nil {
@@ -63,9 +144,42 @@ func getConfig(configFile string) (configuration, error) {
 		if credential.invalid() {
 			return configuration{}, fmt.Errorf("invalid credentials configuration detected for user [%s]", credential.Username)
 		}
+		if !knownRegistry(credential.registry(), c.Registries) {
+			return configuration{}, fmt.Errorf("unknown registry %s for user [%s]", credential.registry(), credential.Username)
+		}
+		if err := credential.checkTokenType(); err != nil {
+			return configuration{}, fmt.Errorf("invalid token for user [%s]: %v", credential.Username, err)
+		}
+		if credential.Pool != "" && credential.Anonymous {
+			return configuration{}, fmt.Errorf("anonymous credentials can't be part of pool %s", credential.Pool)
+		}
+	}
+
+	for name, pool := range c.Pools {
+		if !knownRegistry(pool.registry(), c.Registries) {
+			return configuration{}, fmt.Errorf("unknown registry %s for pool [%s]", pool.registry(), name)
+		}
+	}
+	if err := configurePools(&c); err != nil {
+		return configuration{}, err
+	}
+
+	for name, module := range c.Modules {
+		if module.invalid() {
+			return configuration{}, fmt.Errorf("invalid credentials configuration detected for module [%s]", name)
+		}
+		if !knownRegistry(module.registry(), c.Registries) {
+			return configuration{}, fmt.Errorf("unknown registry %s for module [%s]", module.registry(), name)
+		}
+		if err := module.checkTokenType(); err != nil {
+			return configuration{}, fmt.Errorf("invalid token for module [%s]: %v", name, err)
+		}
 	}
 
-	if c.UpdateInterval == 0 {
+	// The proxy and the registry logs read the limits from real pulls, so they
+	// need no update interval when there is nothing to probe.
+	passive := c.Proxy.Enabled || c.RegistryLogs.Path != ""
+	if c.UpdateInterval == 0 && !c.ProbeOnly && !(passive && len(c.Credentials) == 0) {
 		return configuration{}, fmt.Errorf("update interval must be set")
 	}
 
@@ -73,5 +187,62 @@ func getConfig(configFile string) (configuration, error) {
 		return configuration{}, fmt.Errorf("timeout must be set")
 	}
 
+	if c.AdaptivePolling.Enabled {
+		if c.AdaptivePolling.MinInterval == 0 || c.AdaptivePolling.MaxInterval == 0 {
+			return configuration{}, fmt.Errorf("adaptive polling requires min_interval and max_interval")
+		}
+		if c.AdaptivePolling.MinInterval > c.AdaptivePolling.MaxInterval {
+			return configuration{}, fmt.Errorf("adaptive polling min_interval must not be greater than max_interval")
+		}
+	}
+
+	if c.Pushgateway.URL != "" && (c.CollectOnScrape || c.ProbeOnly) {
+		return configuration{}, fmt.Errorf("pushgateway can't be used together with collect_on_scrape or probe_only")
+	}
+
+	if c.OTLP.ReplacePrometheus && c.OTLP.Endpoint == "" {
+		return configuration{}, fmt.Errorf("otlp replace_prometheus requires an endpoint")
+	}
+
+	if c.OTLP.Endpoint != "" && (c.CollectOnScrape || c.ProbeOnly) {
+		return configuration{}, fmt.Errorf("otlp can't be used together with collect_on_scrape or probe_only")
+	}
+
+	if c.RemoteWrite.URL != "" && (c.CollectOnScrape || c.ProbeOnly) {
+		return configuration{}, fmt.Errorf("remote_write can't be used together with collect_on_scrape or probe_only")
+	}
+
+	if len(c.Alerts.Webhooks) > 0 && (c.CollectOnScrape || c.ProbeOnly) {
+		return configuration{}, fmt.Errorf("alerts can't be used together with collect_on_scrape or probe_only")
+	}
+
+	if c.Proxy.Enabled && (c.CollectOnScrape || c.ProbeOnly) {
+		return configuration{}, fmt.Errorf("proxy can't be used together with collect_on_scrape or probe_only")
+	}
+
+	if c.RegistryLogs.Path != "" && (c.CollectOnScrape || c.ProbeOnly) {
+		return configuration{}, fmt.Errorf("registry_logs can't be used together with collect_on_scrape or probe_only")
+	}
+
+	if len(c.Broker.Tokens) > 0 && (c.CollectOnScrape || c.ProbeOnly) {
+		return configuration{}, fmt.Errorf("broker can't be used together with collect_on_scrape or probe_only")
+	}
+
+	// The lease timings are derived from the update interval.
+	if c.LeaderElection.Backend != "" && c.UpdateInterval == 0 {
+		return configuration{}, fmt.Errorf("leader_election requires update_interval")
+	}
+
+	if c.LeaderElection.Backend != "" && (c.CollectOnScrape || c.ProbeOnly) {
+		return configuration{}, fmt.Errorf("leader_election can't be used together with collect_on_scrape or probe_only")
+	}
+
+	if c.StateSaveInterval == 0 {
+		c.StateSaveInterval = c.UpdateInterval
+	}
+	if c.StateFile != "" && c.StateSaveInterval == 0 {
+		return configuration{}, fmt.Errorf("state save interval must be set")
+	}
+
 	return c, nil
 }
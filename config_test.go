@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -97,3 +99,85 @@ func TestMissingTimeout(t *testing.T) {
 		t.Fatalf("expected error for missing timeout, got %v", err)
 	}
 }
+
+func TestCheckTokenType(t *testing.T) {
+	tests := []struct {
+		name       string
+		credential credentials
+		wantErr    bool
+	}{
+		{
+			name:       "When no token type is set then the password is accepted",
+			credential: credentials{Username: "user", Password: "pass"},
+		},
+		{
+			name:       "When a personal access token is declared then it is accepted",
+			credential: credentials{Username: "user", Password: "dckr_pat_abc", TokenType: "pat"},
+		},
+		{
+			name:       "When an organization access token is declared then it is accepted",
+			credential: credentials{Username: "myorg", Password: "dckr_oat_abc", TokenType: "oat"},
+		},
+		{
+			name:       "When a personal access token is declared as an organization token then it is rejected",
+			credential: credentials{Username: "myorg", Password: "dckr_pat_abc", TokenType: "oat"},
+			wantErr:    true,
+		},
+		{
+			name:       "When a token type is set on another registry then the prefix is not checked",
+			credential: credentials{Username: "user", Password: "ghp_abc", TokenType: "pat", Registry: "ghcr"},
+		},
+		{
+			name:       "When the token type is unknown then it is rejected",
+			credential: credentials{Username: "user", Password: "pass", TokenType: "jwt"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.credential.checkTokenType()
+			if tt.wantErr && err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReplacePrometheusRequiresOTLPEndpoint(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+credentials:
+  - username: user
+    password: pass
+update_interval: 1m
+timeout: 10s
+otlp:
+  replace_prometheus: true
+`
+	if err := os.WriteFile(configFile, []byte(content), 0o600); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := getConfig(configFile); err == nil {
+		t.Fatal("expected error for replace_prometheus without an endpoint, got nil")
+	}
+}
+
+func TestLeaderElectionRequiresUpdateInterval(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+timeout: 10s
+proxy:
+  enabled: true
+leader_election:
+  backend: file
+`
+	if err := os.WriteFile(configFile, []byte(content), 0o600); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := getConfig(configFile); err == nil {
+		t.Fatal("expected error for leader_election without update_interval, got nil")
+	}
+}
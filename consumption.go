@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxSamples bounds the history kept per account regardless of the window size.
+const maxSamples = 1000
+
+type sample struct {
+	Time      time.Time `json:"time"`
+	Remaining int       `json:"remaining"`
+}
+
+type consumptionEstimate struct {
+	// samples is the number of readings the estimate is based on
+	samples int
+	// refilled is set when the reading showed the window rolled over
+	refilled     bool
+	pullsPerHour float64
+	// exhaustionSeconds is only meaningful when exhausting is true, that is,
+	// when pulls are being consumed within the current window.
+	exhaustionSeconds float64
+	exhausting        bool
+	resetTimestamp    float64
+}
+
+// consumptionTracker keeps a short history of the remaining pulls per account
+// to estimate how fast they are being consumed.
+type consumptionTracker struct {
+	mutex     sync.Mutex
+	history   map[string][]sample
+	estimates map[string]consumptionEstimate
+}
+
+func newConsumptionTracker() *consumptionTracker {
+	return &consumptionTracker{
+		history:   map[string][]sample{},
+		estimates: map[string]consumptionEstimate{},
+	}
+}
+
+var consumption = newConsumptionTracker()
+
+// observe records a reading for an account and returns the updated estimate.
+// A reading with more remaining pulls than the previous one means the window
+// rolled over, so the history is restarted instead of fitting across the refill.
+func (t *consumptionTracker) observe(account string, l limits, now time.Time) consumptionEstimate {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	history := t.history[account]
+	refilled := len(history) > 0 && l.remaining > history[len(history)-1].Remaining
+	if refilled {
+		history = nil
+	}
+	history = append(history, sample{Time: now, Remaining: l.remaining})
+
+	window := time.Duration(l.limitWindow) * time.Second
+	start := 0
+	for start < len(history)-1 && (len(history)-start > maxSamples || (window > 0 && now.Sub(history[start].Time) > window)) {
+		start++
+	}
+	history = history[start:]
+	t.history[account] = history
+
+	// Registries that send the IETF headers tell when the quota resets.
+	resetIn := l.remainingWindow
+	if l.reset > 0 {
+		resetIn = l.reset
+	}
+	estimate := consumptionEstimate{
+		samples:        len(history),
+		refilled:       refilled,
+		resetTimestamp: timestampSeconds(now.Add(time.Duration(resetIn) * time.Second)),
+	}
+	slope, ok := fitSlope(history)
+	if ok && slope < 0 {
+		estimate.pullsPerHour = -slope * time.Hour.Seconds()
+		estimate.exhaustionSeconds = float64(l.remaining) / -slope
+		estimate.exhausting = true
+	}
+	t.estimates[account] = estimate
+	return estimate
+}
+
+// lastEstimate returns the estimate computed with the latest reading of an account.
+func (t *consumptionTracker) lastEstimate(account string) (consumptionEstimate, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	estimate, ok := t.estimates[account]
+	return estimate, ok
+}
+
+// fitSlope returns the least squares slope of the remaining pulls over time in
+// pulls per second.
+func fitSlope(history []sample) (float64, bool) {
+	if len(history) < 2 {
+		return 0, false
+	}
+	origin := history[0].Time
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range history {
+		x := s.Time.Sub(origin).Seconds()
+		y := float64(s.Remaining)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	n := float64(len(history))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+	return (n*sumXY - sumX*sumY) / denominator, true
+}
+
+// samples returns a copy of the history kept for an account.
+func (t *consumptionTracker) samples(account string) []sample {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]sample(nil), t.history[account]...)
+}
+
+// restore replaces the history of an account, for example with the one loaded
+// from the state file.
+func (t *consumptionTracker) restore(account string, history []sample) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.history[account] = append([]sample(nil), history...)
+}
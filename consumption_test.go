@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestConsumptionTracker(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	reading := func(remaining int) limits {
+		return limits{limit: 100, remaining: remaining, limitWindow: 21600, remainingWindow: 3600}
+	}
+
+	tests := []struct {
+		name               string
+		remaining          []int
+		wantExhausting     bool
+		wantPullsPerHour   float64
+		wantExhaustionSecs float64
+	}{
+		{
+			name:           "When there is a single reading then no exhaustion is estimated",
+			remaining:      []int{100},
+			wantExhausting: false,
+		},
+		{
+			name:           "When the remaining pulls don't change then no exhaustion is estimated",
+			remaining:      []int{80, 80, 80},
+			wantExhausting: false,
+		},
+		{
+			name:               "When pulls are consumed steadily then the rate and exhaustion are estimated",
+			remaining:          []int{90, 80, 70, 60},
+			wantExhausting:     true,
+			wantPullsPerHour:   120,
+			wantExhaustionSecs: 1800,
+		},
+		{
+			name:               "When the window rolls over then readings before the refill are ignored",
+			remaining:          []int{10, 5, 100, 90, 80},
+			wantExhausting:     true,
+			wantPullsPerHour:   120,
+			wantExhaustionSecs: 2400,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newConsumptionTracker()
+			var estimate consumptionEstimate
+			for i, remaining := range tt.remaining {
+				estimate = tracker.observe("user1", reading(remaining), start.Add(time.Duration(i)*5*time.Minute))
+			}
+			if estimate.exhausting != tt.wantExhausting {
+				t.Fatalf("expected exhausting to be %v, got %v", tt.wantExhausting, estimate.exhausting)
+			}
+			if math.Abs(estimate.pullsPerHour-tt.wantPullsPerHour) > 0.001 {
+				t.Errorf("expected %f pulls per hour, got %f", tt.wantPullsPerHour, estimate.pullsPerHour)
+			}
+			if last, ok := tracker.lastEstimate("user1"); !ok || last != estimate {
+				t.Errorf("expected the last estimate to be kept, got %+v", last)
+			}
+			if math.Abs(estimate.exhaustionSeconds-tt.wantExhaustionSecs) > 0.001 {
+				t.Errorf("expected exhaustion in %f seconds, got %f", tt.wantExhaustionSecs, estimate.exhaustionSeconds)
+			}
+			last := start.Add(time.Duration(len(tt.remaining)-1) * 5 * time.Minute)
+			if want := float64(last.Add(time.Hour).Unix()); estimate.resetTimestamp != want {
+				t.Errorf("expected reset at %f, got %f", want, estimate.resetTimestamp)
+			}
+		})
+	}
+}
+
+func TestConsumptionTrackerDropsSamplesOutsideWindow(t *testing.T) {
+	tracker := newConsumptionTracker()
+	start := time.Unix(1700000000, 0)
+	for i := range 10 {
+		tracker.observe("user1", limits{limit: 100, remaining: 100 - i, limitWindow: 60}, start.Add(time.Duration(i)*time.Minute))
+	}
+	if got := len(tracker.history["user1"]); got != 2 {
+		t.Fatalf("expected 2 samples within the window, got %d", got)
+	}
+}
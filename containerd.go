@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const containerdSubscribeMethod = "/containerd.services.events.v1.Events/Subscribe"
+
+type containerdEventsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Socket is the path of the containerd gRPC socket.
+	Socket string `yaml:"socket"`
+	// RetryInterval is how long to wait before reconnecting when the event
+	// stream ends.
+	RetryInterval time.Duration `yaml:"retry_interval"`
+	// ResolvePods looks up the pods of the node through the Kubernetes API to
+	// label every pull with the namespace of the pod it was made for.
+	ResolvePods bool `yaml:"resolve_pods"`
+}
+
+// containerdDeduplicationWindow is how long the references a pull creates are
+// counted as the same pull. The CRI plugin creates an image for the tag, the
+// digest and the ID of every image it pulls.
+const containerdDeduplicationWindow = 10 * time.Second
+
+// pendingDigest is a pull by tag whose digest reference hasn't been seen yet.
+type pendingDigest struct {
+	repository string
+	seen       time.Time
+}
+
+// containerdEventsWatcher counts the image pulls of containerd by following its
+// image events, which include the pulls of Kubernetes through the CRI plugin.
+// A nil containerdEventsWatcher does nothing.
+type containerdEventsWatcher struct {
+	config containerdEventsConfig
+	conn   *grpc.ClientConn
+	node   string
+	// pods is the Kubernetes client used to resolve the pods of the node, nil
+	// when resolve_pods is disabled.
+	pods    kubernetes.Interface
+	timeout time.Duration
+
+	mutex   sync.Mutex
+	recent  map[string]time.Time
+	pending []pendingDigest
+	now     func() time.Time
+}
+
+func newContainerdEventsWatcher(config configuration) (*containerdEventsWatcher, error) {
+	if !config.ContainerdEvents.Enabled {
+		return nil, nil
+	}
+	eventsConfig := config.ContainerdEvents
+	if eventsConfig.Socket == "" {
+		eventsConfig.Socket = "/run/containerd/containerd.sock"
+	}
+	if eventsConfig.RetryInterval == 0 {
+		eventsConfig.RetryInterval = 5 * time.Second
+	}
+
+	var pods kubernetes.Interface
+	if eventsConfig.ResolvePods {
+		restConfig, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, err
+		}
+		pods, err = kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := grpc.NewClient("unix://"+eventsConfig.Socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &containerdEventsWatcher{
+		config:  eventsConfig,
+		conn:    conn,
+		node:    nodeName(config.NodeName),
+		pods:    pods,
+		timeout: config.Timeout,
+		recent:  map[string]time.Time{},
+		now:     time.Now,
+	}, nil
+}
+
+// start follows the event stream until ctx is done, reconnecting whenever it
+// ends.
+func (w *containerdEventsWatcher) start(ctx context.Context) {
+	if w == nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"socket": w.config.Socket,
+		"node":   w.node,
+	}).Info("Watching containerd image pulls")
+	go func() {
+		for {
+			err := w.watch(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			log.WithFields(log.Fields{
+				"socket": w.config.Socket,
+			}).Warnf("containerd event stream ended, reconnecting: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.config.RetryInterval):
+			}
+		}
+	}()
+}
+
+// watch counts the image events of a single subscription to the event stream.
+func (w *containerdEventsWatcher) watch(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := w.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, containerdSubscribeMethod, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		return err
+	}
+	request := encodeSubscribeRequest([]string{`topic=="/images/create"`, `topic=="/images/update"`})
+	if err := stream.SendMsg(&request); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		var envelope []byte
+		if err := stream.RecvMsg(&envelope); err != nil {
+			return err
+		}
+		event, err := decodeContainerdEnvelope(envelope)
+		if err != nil {
+			log.Warnf("Ignoring containerd event: %v", err)
+			continue
+		}
+		if w.duplicate(event) {
+			continue
+		}
+		countImagePull(event.image, event.namespace, w.podNamespace(ctx, event.image), w.node)
+	}
+}
+
+// podNamespace returns the namespace of the pod of the node that reference was
+// pulled for, or an empty string when pods aren't resolved or none uses it.
+func (w *containerdEventsWatcher) podNamespace(ctx context.Context, reference string) string {
+	if w.pods == nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	pods, err := w.pods.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + w.node})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"node": w.node,
+		}).Warnf("Failed to list the pods of the node: %v", err)
+		return ""
+	}
+	return pullingNamespace(pods.Items, reference)
+}
+
+// pullingNamespace returns the namespace of the pod an image was pulled for
+// among the pods using it. The image is pulled before the container using it
+// starts, so the oldest pod with such a container waiting is preferred, then
+// the oldest pod using the image at all.
+func pullingNamespace(pods []corev1.Pod, reference string) string {
+	want := normalizeImageReference(reference)
+	var waiting, started []corev1.Pod
+	for _, pod := range pods {
+		uses, pending := podImageState(pod, want)
+		switch {
+		case uses && pending:
+			waiting = append(waiting, pod)
+		case uses:
+			started = append(started, pod)
+		}
+	}
+	candidates := waiting
+	if len(candidates) == 0 {
+		candidates = started
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	oldest := candidates[0]
+	for _, pod := range candidates[1:] {
+		if pod.CreationTimestamp.Before(&oldest.CreationTimestamp) {
+			oldest = pod
+		}
+	}
+	return oldest.Namespace
+}
+
+// podImageState reports whether a container of the pod uses the normalized
+// image reference, and whether any of those containers hasn't started yet.
+func podImageState(pod corev1.Pod, reference string) (bool, bool) {
+	started := map[string]bool{}
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses, pod.Status.EphemeralContainerStatuses} {
+		for _, status := range statuses {
+			started[status.Name] = status.State.Running != nil || status.State.Terminated != nil
+		}
+	}
+	images := map[string]string{}
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, container := range containers {
+			images[container.Name] = container.Image
+		}
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		images[container.Name] = container.Image
+	}
+
+	uses, pending := false, false
+	for name, image := range images {
+		if normalizeImageReference(image) != reference {
+			continue
+		}
+		uses = true
+		if !started[name] {
+			pending = true
+		}
+	}
+	return uses, pending
+}
+
+// duplicate reports whether the event is a reference already counted within
+// the deduplication window, the digest reference of a pull by tag, or a
+// reference that doesn't name a repository. References are compared in full,
+// so concurrent pulls of different tags or digests are all counted.
+func (w *containerdEventsWatcher) duplicate(event containerdImageEvent) bool {
+	if event.image == "" || strings.HasPrefix(event.image, "sha256:") {
+		return true
+	}
+	key := event.namespace + "/" + event.image
+	registry, image := parseImageReference(event.image)
+	repository := strings.Join([]string{event.namespace, registry, image}, "/")
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	now := w.now()
+	for k, seen := range w.recent {
+		if now.Sub(seen) >= containerdDeduplicationWindow {
+			delete(w.recent, k)
+		}
+	}
+	pending := w.pending[:0]
+	for _, p := range w.pending {
+		if now.Sub(p.seen) < containerdDeduplicationWindow {
+			pending = append(pending, p)
+		}
+	}
+	w.pending = pending
+
+	if _, ok := w.recent[key]; ok {
+		return true
+	}
+	w.recent[key] = now
+	if !strings.Contains(event.image, "@") {
+		w.pending = append(w.pending, pendingDigest{repository: repository, seen: now})
+		return false
+	}
+	// Every pull by tag also creates a digest reference of the repository,
+	// which the event doesn't tie to the tag. Counting each of them against a
+	// pull by tag keeps the total right even when pulls by digest of the same
+	// repository happen at the same time.
+	for i, p := range w.pending {
+		if p.repository == repository {
+			w.pending = append(w.pending[:i], w.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// containerdImageEvent is an /images/create or /images/update event.
+type containerdImageEvent struct {
+	namespace string
+	topic     string
+	image     string
+}
+
+// encodeSubscribeRequest encodes a containerd.services.events.v1.SubscribeRequest.
+func encodeSubscribeRequest(filters []string) []byte {
+	var request []byte
+	for _, filter := range filters {
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendString(request, filter)
+	}
+	return request
+}
+
+// decodeContainerdEnvelope decodes a containerd.services.events.v1.Envelope
+// holding an ImageCreate or ImageUpdate event, which both carry the image name
+// in their first field.
+func decodeContainerdEnvelope(data []byte) (containerdImageEvent, error) {
+	envelope, err := bytesFields(data)
+	if err != nil {
+		return containerdImageEvent{}, err
+	}
+	event := containerdImageEvent{namespace: string(envelope[2]), topic: string(envelope[3])}
+	if event.topic != "/images/create" && event.topic != "/images/update" {
+		return containerdImageEvent{}, fmt.Errorf("unexpected topic %q", event.topic)
+	}
+	payload, err := bytesFields(envelope[4])
+	if err != nil {
+		return containerdImageEvent{}, err
+	}
+	image, err := bytesFields(payload[2])
+	if err != nil {
+		return containerdImageEvent{}, err
+	}
+	event.image = string(image[1])
+	return event, nil
+}
+
+// bytesFields returns the length-delimited fields of a protobuf message by
+// number, skipping the others.
+func bytesFields(data []byte) (map[protowire.Number][]byte, error) {
+	fields := map[protowire.Number][]byte{}
+	for len(data) > 0 {
+		number, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ == protowire.BytesType {
+			value, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			fields[number] = value
+			data = data[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(number, typ, data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return fields, nil
+}
+
+// rawCodec passes already encoded protobuf messages through gRPC, which avoids
+// depending on the generated containerd API for two small messages.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	message, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return *message, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	message, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*message = append((*message)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
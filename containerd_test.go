@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// encodeContainerdEnvelope encodes an image event the way containerd does,
+// wrapped in an Any.
+func encodeContainerdEnvelope(namespace, topic, name string) []byte {
+	var image []byte
+	image = protowire.AppendTag(image, 1, protowire.BytesType)
+	image = protowire.AppendString(image, name)
+
+	var payload []byte
+	payload = protowire.AppendTag(payload, 1, protowire.BytesType)
+	payload = protowire.AppendString(payload, "containerd.events.ImageCreate")
+	payload = protowire.AppendTag(payload, 2, protowire.BytesType)
+	payload = protowire.AppendBytes(payload, image)
+
+	var envelope []byte
+	envelope = protowire.AppendTag(envelope, 1, protowire.BytesType)
+	envelope = protowire.AppendBytes(envelope, []byte{0x08, 0x01})
+	envelope = protowire.AppendTag(envelope, 2, protowire.BytesType)
+	envelope = protowire.AppendString(envelope, namespace)
+	envelope = protowire.AppendTag(envelope, 3, protowire.BytesType)
+	envelope = protowire.AppendString(envelope, topic)
+	envelope = protowire.AppendTag(envelope, 4, protowire.BytesType)
+	envelope = protowire.AppendBytes(envelope, payload)
+	return envelope
+}
+
+// newFakeContainerd serves the containerd events API on a Unix socket and
+// streams envelopes to every subscriber, then ends the stream.
+func newFakeContainerd(t *testing.T, envelopes [][]byte) (string, chan []string) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "containerd")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "containerd.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	subscriptions := make(chan []string, 10)
+	server := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		if method != containerdSubscribeMethod {
+			t.Errorf("unexpected method %s", method)
+			return nil
+		}
+		var request []byte
+		if err := stream.RecvMsg(&request); err != nil {
+			return err
+		}
+		var filters []string
+		for len(request) > 0 {
+			_, _, n := protowire.ConsumeTag(request)
+			request = request[n:]
+			filter, n := protowire.ConsumeString(request)
+			request = request[n:]
+			filters = append(filters, filter)
+		}
+		subscriptions <- filters
+		for _, envelope := range envelopes {
+			if err := stream.SendMsg(&envelope); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+	return socket, subscriptions
+}
+
+func TestContainerdEventsWatcher(t *testing.T) {
+	socket, subscriptions := newFakeContainerd(t, [][]byte{
+		// A CRI pull creates the tag, the digest and the ID of the image.
+		encodeContainerdEnvelope("k8s.io", "/images/create", "docker.io/library/redis:7"),
+		encodeContainerdEnvelope("k8s.io", "/images/create", "docker.io/library/redis@sha256:0123"),
+		encodeContainerdEnvelope("k8s.io", "/images/create", "sha256:4567"),
+		encodeContainerdEnvelope("default", "/images/update", "docker.io/library/redis:7"),
+		encodeContainerdEnvelope("k8s.io", "/images/create", "ghcr.io/org/app:v1"),
+		encodeContainerdEnvelope("k8s.io", "/containers/create", "ignored"),
+	})
+	watcher, err := newContainerdEventsWatcher(configuration{
+		NodeName:         "node1",
+		ContainerdEvents: containerdEventsConfig{Enabled: true, Socket: socket, RetryInterval: time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tests := []struct {
+		image     string
+		registry  string
+		namespace string
+		want      float64
+		before    float64
+	}{
+		{image: "library/redis", registry: "dockerhub", namespace: "k8s.io", want: 1},
+		{image: "library/redis", registry: "dockerhub", namespace: "default", want: 1},
+		{image: "org/app", registry: "ghcr.io", namespace: "k8s.io", want: 1},
+	}
+	for i, tt := range tests {
+		tests[i].before = testutil.ToFloat64(imagePulls.WithLabelValues(tt.image, tt.registry, tt.namespace, "", "node1"))
+	}
+
+	if err := watcher.watch(ctx); err == nil {
+		t.Fatal("expected the stream to end with an error, got nil")
+	}
+	filters := <-subscriptions
+	if len(filters) != 2 || filters[0] != `topic=="/images/create"` || filters[1] != `topic=="/images/update"` {
+		t.Errorf("expected a subscription to image events, got %v", filters)
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(imagePulls.WithLabelValues(tt.image, tt.registry, tt.namespace, "", "node1")) - tt.before; got != tt.want {
+			t.Errorf("expected %f pulls of %s in %s, got %f", tt.want, tt.image, tt.namespace, got)
+		}
+	}
+}
+
+func TestContainerdEventsWatcherDeduplicatesWithinWindow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	watcher := &containerdEventsWatcher{recent: map[string]time.Time{}, now: func() time.Time { return now }}
+	event := func(image string) containerdImageEvent {
+		return containerdImageEvent{namespace: "k8s.io", image: image}
+	}
+
+	tests := []struct {
+		name      string
+		image     string
+		duplicate bool
+	}{
+		{"When a tag is pulled then it is counted", "docker.io/library/busybox:1.36", false},
+		{"When another tag is pulled at the same time then it is counted", "docker.io/library/busybox:1.37", false},
+		{"When the digest of the first tag is created then it is ignored", "docker.io/library/busybox@sha256:0123", true},
+		{"When the digest of the second tag is created then it is ignored", "docker.io/library/busybox@sha256:4567", true},
+		{"When the ID is created then it is ignored", "sha256:89ab", true},
+		{"When the same tag is seen again then it is ignored", "docker.io/library/busybox:1.36", true},
+		{"When a digest is pulled then it is counted", "docker.io/library/busybox@sha256:cdef", false},
+	}
+	for _, tt := range tests {
+		if got := watcher.duplicate(event(tt.image)); got != tt.duplicate {
+			t.Errorf("%s: expected duplicate %v, got %v", tt.name, tt.duplicate, got)
+		}
+	}
+
+	now = now.Add(containerdDeduplicationWindow)
+	if watcher.duplicate(event("docker.io/library/busybox:1.36")) {
+		t.Error("expected a pull after the window to be counted")
+	}
+}
+
+func TestContainerdEventsWatcherDisabled(t *testing.T) {
+	watcher, err := newContainerdEventsWatcher(configuration{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if watcher != nil {
+		t.Fatal("expected no watcher when disabled")
+	}
+	watcher.start(context.Background())
+}
+
+func newPod(namespace, name string, created time.Time, image string, started bool) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, CreationTimestamp: metav1.NewTime(created)},
+		Spec: corev1.PodSpec{
+			NodeName:   "node1",
+			Containers: []corev1.Container{{Name: "main", Image: image}},
+		},
+	}
+	if started {
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "main", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}}
+	} else {
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "main", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}}}}
+	}
+	return pod
+}
+
+func TestPullingNamespace(t *testing.T) {
+	created := time.Unix(1700000000, 0)
+	initPod := newPod("ci", "init", created.Add(time.Minute), "busybox", true)
+	initPod.Spec.InitContainers = []corev1.Container{{Name: "setup", Image: "docker.io/library/nginx:1.25"}}
+	pods := []corev1.Pod{
+		*newPod("web", "running", created, "nginx:1.25", true),
+		*initPod,
+		*newPod("batch", "newer", created.Add(2*time.Minute), "nginx:1.25", false),
+		*newPod("cache", "redis", created, "redis:7", true),
+	}
+
+	tests := []struct {
+		name      string
+		reference string
+		want      string
+	}{
+		{"When several pods wait for the image then the oldest one is chosen", "docker.io/library/nginx:1.25", "ci"},
+		{"When every pod using the image started then the oldest one is chosen", "docker.io/library/redis:7", "cache"},
+		{"When no pod uses the tag then the namespace is unknown", "docker.io/library/nginx:1.26", ""},
+	}
+	for _, tt := range tests {
+		if got := pullingNamespace(pods, tt.reference); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestContainerdEventsWatcherResolvesPods(t *testing.T) {
+	socket, _ := newFakeContainerd(t, [][]byte{
+		encodeContainerdEnvelope("k8s.io", "/images/create", "docker.io/library/memcached:1.6"),
+	})
+	watcher, err := newContainerdEventsWatcher(configuration{
+		NodeName:         "node1",
+		Timeout:          time.Second,
+		ContainerdEvents: containerdEventsConfig{Enabled: true, Socket: socket, RetryInterval: time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	client := fake.NewClientset(newPod("shop", "cache", time.Now(), "memcached:1.6", false))
+	var selector string
+	client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		selector = action.(k8stesting.ListAction).GetListRestrictions().Fields.String()
+		return false, nil, nil
+	})
+	watcher.pods = client
+	pulls := imagePulls.WithLabelValues("library/memcached", "dockerhub", "k8s.io", "shop", "node1")
+	before := testutil.ToFloat64(pulls)
+
+	if err := watcher.watch(context.Background()); err == nil {
+		t.Fatal("expected the stream to end with an error, got nil")
+	}
+	if got := testutil.ToFloat64(pulls) - before; got != 1 {
+		t.Errorf("expected the pull to be counted in the namespace of the pod, got %f", got)
+	}
+	if selector != "spec.nodeName=node1" {
+		t.Errorf("expected the pods of the node to be listed, got selector %q", selector)
+	}
+}
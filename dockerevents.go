@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type dockerEventsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Socket is the path of the Docker Engine API socket.
+	Socket string `yaml:"socket"`
+	// RetryInterval is how long to wait before reconnecting when the event
+	// stream ends.
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+// dockerEvent is the part of a Docker Engine event needed to attribute pulls.
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID string `json:"ID"`
+	} `json:"Actor"`
+}
+
+// dockerEventsWatcher counts the image pulls of a Docker daemon by following
+// its event stream, so the pulls consumed can be attributed to images. A nil
+// dockerEventsWatcher does nothing.
+type dockerEventsWatcher struct {
+	config dockerEventsConfig
+	client *http.Client
+	node   string
+}
+
+func newDockerEventsWatcher(config configuration) (*dockerEventsWatcher, error) {
+	if !config.DockerEvents.Enabled {
+		return nil, nil
+	}
+	eventsConfig := config.DockerEvents
+	if eventsConfig.Socket == "" {
+		eventsConfig.Socket = "/var/run/docker.sock"
+	}
+	if eventsConfig.RetryInterval == 0 {
+		eventsConfig.RetryInterval = 5 * time.Second
+	}
+
+	socket := eventsConfig.Socket
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	return &dockerEventsWatcher{config: eventsConfig, client: client, node: nodeName(config.NodeName)}, nil
+}
+
+// start follows the event stream until ctx is done, reconnecting whenever it
+// ends.
+func (w *dockerEventsWatcher) start(ctx context.Context) {
+	if w == nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"socket": w.config.Socket,
+	}).Info("Watching Docker image pulls")
+	go func() {
+		for {
+			err := w.watch(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			log.WithFields(log.Fields{
+				"socket": w.config.Socket,
+			}).Warnf("Docker event stream ended, reconnecting: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.config.RetryInterval):
+			}
+		}
+	}()
+}
+
+// watch counts the pull events of a single connection to the event stream.
+func (w *dockerEventsWatcher) watch(ctx context.Context) error {
+	filters, err := json.Marshal(map[string][]string{"type": {"image"}, "event": {"pull"}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://docker/events?filters="+url.QueryEscape(string(filters)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Errorf("Error closing response body: %v", err)
+		}
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to subscribe to events: status code %d", resp.StatusCode)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event dockerEvent
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("connection closed by the daemon")
+			}
+			return err
+		}
+		if event.Type != "image" || event.Action != "pull" {
+			continue
+		}
+		countImagePull(event.Actor.ID, "", "", w.node)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newFakeEngineAPI serves the Docker Engine API on a Unix socket and streams
+// events to every subscriber, then closes the connection.
+func newFakeEngineAPI(t *testing.T, events []string) (string, chan string) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "docker")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	filters := make(chan string, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/events" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		filters <- r.URL.Query().Get("filters")
+		w.Header().Set("Content-Type", "application/json")
+		for _, event := range events {
+			_, _ = fmt.Fprintln(w, event)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return socket, filters
+}
+
+func TestDockerEventsWatcher(t *testing.T) {
+	socket, filters := newFakeEngineAPI(t, []string{
+		`{"Type":"image","Action":"pull","Actor":{"ID":"nginx:latest","Attributes":{"name":"nginx"}}}`,
+		`{"Type":"image","Action":"pull","Actor":{"ID":"nginx:1.27"}}`,
+		`{"Type":"image","Action":"pull","Actor":{"ID":"ghcr.io/org/app@sha256:0123"}}`,
+		`{"Type":"image","Action":"tag","Actor":{"ID":"nginx:latest"}}`,
+	})
+	watcher, err := newDockerEventsWatcher(configuration{
+		NodeName:     "node1",
+		DockerEvents: dockerEventsConfig{Enabled: true, Socket: socket, RetryInterval: time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nginx := imagePulls.WithLabelValues("library/nginx", "dockerhub", "", "", "node1")
+	app := imagePulls.WithLabelValues("org/app", "ghcr.io", "", "", "node1")
+	nginxBefore, appBefore := testutil.ToFloat64(nginx), testutil.ToFloat64(app)
+	if err := watcher.watch(ctx); err == nil {
+		t.Fatal("expected the stream to end with an error, got nil")
+	}
+
+	var subscribed map[string][]string
+	if err := json.Unmarshal([]byte(<-filters), &subscribed); err != nil {
+		t.Fatalf("expected JSON filters, got %v", err)
+	}
+	if len(subscribed["type"]) != 1 || subscribed["type"][0] != "image" || len(subscribed["event"]) != 1 || subscribed["event"][0] != "pull" {
+		t.Errorf("expected a subscription to image pulls, got %v", subscribed)
+	}
+	if got := testutil.ToFloat64(nginx) - nginxBefore; got != 2 {
+		t.Errorf("expected 2 Docker Hub pulls of nginx, got %f", got)
+	}
+	if got := testutil.ToFloat64(app) - appBefore; got != 1 {
+		t.Errorf("expected 1 GHCR pull of org/app, got %f", got)
+	}
+}
+
+func TestDockerEventsWatcherReconnects(t *testing.T) {
+	socket, filters := newFakeEngineAPI(t, nil)
+	watcher, err := newDockerEventsWatcher(configuration{
+		DockerEvents: dockerEventsConfig{Enabled: true, Socket: socket, RetryInterval: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watcher.start(ctx)
+
+	for range 2 {
+		select {
+		case <-filters:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the watcher to reconnect to the event stream")
+		}
+	}
+}
+
+func TestDockerEventsWatcherDisabled(t *testing.T) {
+	watcher, err := newDockerEventsWatcher(configuration{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if watcher != nil {
+		t.Fatal("expected no watcher when disabled")
+	}
+	watcher.start(context.Background())
+}
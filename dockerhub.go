@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,11 +12,29 @@ import (
 	"time"
 )
 
-func getToken(username, password string, timeout time.Duration) (string, error) {
-	url := "https://auth.docker.io/token?service=registry.docker.io&scope=repository:ratelimitpreview/test:pull"
-	req, err := http.NewRequest("GET", url, nil)
+var (
+	tokenURL  = "https://auth.docker.io/token?service=registry.docker.io&scope=repository:ratelimitpreview/test:pull"
+	limitsURL = "https://registry-1.docker.io/v2/ratelimitpreview/test/manifests/latest"
+)
+
+// errAuthFailed marks failures caused by the credential itself, such as a wrong
+// password or an expired or revoked access token, rather than by the registry.
+var errAuthFailed = errors.New("authentication failed")
+
+// authToken is a registry token and the time it expires at, which is zero when
+// the registry doesn't tell. subject and username are read from the claims of
+// tokens that are JWTs.
+type authToken struct {
+	token     string
+	expiresAt time.Time
+	subject   string
+	username  string
+}
+
+func getToken(username, password string, timeout time.Duration) (authToken, error) {
+	req, err := http.NewRequest("GET", tokenURL, nil)
 	if err != nil {
-		return "", err
+		return authToken{}, err
 	}
 	if username != "" && password != "" {
 		req.SetBasicAuth(username, password)
@@ -24,7 +43,7 @@ func getToken(username, password string, timeout time.Duration) (string, error)
 	client := &http.Client{Timeout: timeout}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return authToken{}, err
 	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
@@ -33,40 +52,137 @@ func getToken(username, password string, timeout time.Duration) (string, error)
 		}
 	}(resp.Body)
 
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return authToken{}, authFailedError(resp)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to fetch token: status code %d", resp.StatusCode)
+		return authToken{}, fmt.Errorf("failed to fetch token: status code %d", resp.StatusCode)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return authToken{}, err
 	}
+	return parseTokenResponse(body, time.Now())
+}
 
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", err
+// parseTokenResponse reads the token handed out by a registry token endpoint,
+// together with its expiry when expires_in is present.
+func parseTokenResponse(body []byte, now time.Time) (authToken, error) {
+	var result struct {
+		Token       string    `json:"token"`
+		AccessToken string    `json:"access_token"`
+		ExpiresIn   int       `json:"expires_in"`
+		IssuedAt    time.Time `json:"issued_at"`
 	}
-	token, ok := result["token"].(string)
-	if !ok {
-		return "", errors.New("token not found in response")
+	if err := json.Unmarshal(body, &result); err != nil {
+		return authToken{}, err
 	}
 
+	token := authToken{token: result.Token}
+	if token.token == "" {
+		token.token = result.AccessToken
+	}
+	if token.token == "" {
+		return authToken{}, errors.New("token not found in response")
+	}
+	if result.ExpiresIn > 0 {
+		issuedAt := result.IssuedAt
+		if issuedAt.IsZero() {
+			issuedAt = now
+		}
+		token.expiresAt = issuedAt.Add(time.Duration(result.ExpiresIn) * time.Second)
+	}
+	if claims, err := parseTokenClaims(token.token); err == nil {
+		token.subject = claims.Subject
+		token.username = claims.DockerHub.Username
+		if token.username == "" {
+			token.username = claims.Username
+		}
+		if token.expiresAt.IsZero() && claims.ExpiresAt > 0 {
+			token.expiresAt = time.Unix(claims.ExpiresAt, 0)
+		}
+	}
 	return token, nil
 }
 
-func getLimits(token string, timeout time.Duration) (int, int, int, int, string, error) {
-	url := "https://registry-1.docker.io/v2/ratelimitpreview/test/manifests/latest"
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	Username  string `json:"username"`
+	DockerHub struct {
+		Username string `json:"username"`
+	} `json:"https://auth.docker.io"`
+}
+
+// parseTokenClaims decodes the claims of a JWT without verifying its
+// signature. They are only used to describe the token, never to trust it.
+func parseTokenClaims(token string) (tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenClaims{}, errors.New("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return tokenClaims{}, fmt.Errorf("failed to decode token claims: %w", err)
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return tokenClaims{}, fmt.Errorf("failed to parse token claims: %w", err)
+	}
+	return claims, nil
+}
+
+// checkIdentity checks that the token was issued for the configured username,
+// which catches credentials pasted with the password of another user.
+// Organization access tokens are issued for the organization and aren't checked.
+func checkIdentity(credential credentials, token authToken) error {
+	if credential.Anonymous || token.username == "" || credential.tokenType() == tokenTypeOAT {
+		return nil
+	}
+	if !strings.EqualFold(token.username, credential.Username) {
+		return fmt.Errorf("%w: token was issued for %s instead of %s", errAuthFailed, token.username, credential.Username)
+	}
+	return nil
+}
+
+// authFailedError describes a rejected credential with the details the token
+// endpoint gave, which tell a wrong password from an expired or revoked token.
+func authFailedError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var result struct {
+		Details string `json:"details"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	message := strings.TrimSpace(string(body))
+	if err := json.Unmarshal(body, &result); err == nil {
+		if result.Details != "" {
+			message = result.Details
+		} else if len(result.Errors) > 0 {
+			message = result.Errors[0].Message
+		}
+	}
+	if message == "" {
+		return fmt.Errorf("%w: status code %d", errAuthFailed, resp.StatusCode)
+	}
+	return fmt.Errorf("%w: status code %d: %s", errAuthFailed, resp.StatusCode, message)
+}
 
-	req, err := http.NewRequest("HEAD", url, nil)
+// getLimits reads the limits from the IETF RateLimit headers when Docker Hub
+// sends them, or from the legacy ratelimit-limit and ratelimit-remaining ones.
+func getLimits(token string, timeout time.Duration) (limits, error) {
+	req, err := http.NewRequest("HEAD", limitsURL, nil)
 	if err != nil {
-		return 0, 0, 0, 0, "", err
+		return limits{}, err
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
 	client := &http.Client{Timeout: timeout}
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, 0, 0, 0, "", err
+		return limits{}, err
 	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
@@ -76,56 +192,169 @@ func getLimits(token string, timeout time.Duration) (int, int, int, int, string,
 	}(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
-		return 0, 0, 0, 0, "", fmt.Errorf("failed to fetch limits: status code %d", resp.StatusCode)
+		return limits{}, fmt.Errorf("failed to fetch limits: status code %d", resp.StatusCode)
 	}
+	return parseLimitsResponse(resp.Header)
+}
 
-	limit := resp.Header.Get("ratelimit-limit")
-	remaining := resp.Header.Get("ratelimit-remaining")
-	source := resp.Header.Get("docker-ratelimit-source")
+// parseLimitsResponse reads the limits from the headers of a Docker Hub
+// manifest response. The limits are unlimited when both legacy headers are
+// absent.
+func parseLimitsResponse(header http.Header) (limits, error) {
+	source := header.Get("docker-ratelimit-source")
+	if l, ok, err := parseStructuredLimits(header); ok {
+		l.source = source
+		return l, err
+	}
 
-	limitInt, limitWindow, remainingInt, remainingWindow, err := parseLimits(limit, remaining)
+	// Docker Hub accounts without a pull rate limit get successful responses
+	// without either header.
+	limit, remaining := header.Get("ratelimit-limit"), header.Get("ratelimit-remaining")
+	if strings.TrimSpace(limit) == "" && strings.TrimSpace(remaining) == "" {
+		return limits{unlimited: true, source: source}, nil
+	}
+	l, err := parseLimits(limit, remaining)
 	if err != nil {
-		return 0, 0, 0, 0, "", err
+		return limits{}, err
 	}
+	l.source = source
+	return l, nil
+}
+
+// windowLimits are the limits of one of the policies sent in a rate limit
+// header, such as the burst and sustained ones in 200;w=21600, 40;w=600.
+type windowLimits struct {
+	policy    string
+	window    int
+	limit     int
+	remaining int
+}
+
+// limitPolicy is a member of a legacy rate limit header.
+type limitPolicy struct {
+	count     int
+	window    int
+	hasWindow bool
+}
 
-	return limitInt, remainingInt, limitWindow, remainingWindow, source, nil
+// parseLimits parses Docker Hub's legacy ratelimit-limit and ratelimit-remaining
+// headers, which must state the window of every policy.
+func parseLimits(limit string, remaining string) (limits, error) {
+	return parseLimitHeaders("ratelimit-limit", limit, "ratelimit-remaining", remaining, true)
 }
 
-func parseLimits(limit string, remaining string) (int, int, int, int, error) {
-	limitParts := strings.Split(limit, ";")
-	limitInt, err := strconv.Atoi(limitParts[0])
+// parseLimitHeaders parses a limit and a remaining header holding one or more
+// comma-separated policies. Every policy is reported in windows and the most
+// restrictive one is the headline.
+func parseLimitHeaders(limitName string, limit string, remainingName string, remaining string, requireWindow bool) (limits, error) {
+	limitPolicies, err := parseLimitPolicies(limitName, limit, requireWindow)
 	if err != nil {
-		return 0, 0, 0, 0, fmt.Errorf("failed to parse ratelimit-limit: %w", err)
+		return limits{}, err
 	}
-	limitWindow := 0
-	if len(limitParts) > 1 {
-		windowParts := strings.Split(limitParts[1], "=")
-		if len(windowParts) > 1 {
-			limitWindow, err = strconv.Atoi(windowParts[1])
-			if err != nil {
-				return 0, 0, 0, 0, fmt.Errorf("failed to parse ratelimit-limit window: %w", err)
+	remainingPolicies, err := parseLimitPolicies(remainingName, remaining, requireWindow)
+	if err != nil {
+		return limits{}, err
+	}
+
+	// A single policy on each side is paired even if the windows differ, the
+	// way Docker Hub always reported them.
+	var windows []windowLimits
+	single := len(limitPolicies) == 1 && len(remainingPolicies) == 1
+	if single {
+		windows = append(windows, windowLimits{
+			window:    limitPolicies[0].window,
+			limit:     limitPolicies[0].count,
+			remaining: remainingPolicies[0].count,
+		})
+	} else {
+		for _, limitPolicy := range limitPolicies {
+			for _, remainingPolicy := range remainingPolicies {
+				if limitPolicy.window == remainingPolicy.window {
+					windows = append(windows, windowLimits{
+						window:    limitPolicy.window,
+						limit:     limitPolicy.count,
+						remaining: remainingPolicy.count,
+					})
+					break
+				}
 			}
 		}
-	} else {
-		return 0, 0, 0, 0, errors.New("ratelimit-limit header does not contain window information")
+	}
+	if len(windows) == 0 {
+		return limits{}, fmt.Errorf("%s header does not match any policy of %s", remainingName, limitName)
 	}
 
-	remainingParts := strings.Split(remaining, ";")
-	remainingInt, err := strconv.Atoi(remainingParts[0])
-	if err != nil {
-		return 0, 0, 0, 0, fmt.Errorf("failed to parse ratelimit-remaining: %w", err)
+	headline := mostRestrictive(windows)
+	remainingWindow := headline.window
+	if single {
+		remainingWindow = remainingPolicies[0].window
+	}
+	return limits{
+		limit:           headline.limit,
+		remaining:       headline.remaining,
+		limitWindow:     headline.window,
+		remainingWindow: remainingWindow,
+		windows:         windows,
+	}, nil
+}
+
+// mostRestrictive returns the window with the fewest remaining pulls, or the
+// smallest limit when they are tied.
+func mostRestrictive(windows []windowLimits) windowLimits {
+	headline := windows[0]
+	for _, window := range windows[1:] {
+		if window.remaining < headline.remaining || (window.remaining == headline.remaining && window.limit < headline.limit) {
+			headline = window
+		}
 	}
-	remainingWindow := 0
-	if len(remainingParts) > 1 {
-		windowParts := strings.Split(remainingParts[1], "=")
-		if len(windowParts) > 1 {
-			remainingWindow, err = strconv.Atoi(windowParts[1])
+	return headline
+}
+
+// parseLimitPolicies parses the comma-separated policies of a header such as
+// 200;w=21600, 40;w=600;comment="burst". Parameters other than w are ignored.
+func parseLimitPolicies(name string, value string, requireWindow bool) ([]limitPolicy, error) {
+	var policies []limitPolicy
+	for _, member := range splitQuoted(value, ',') {
+		parts := splitQuoted(member, ';')
+		count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		policy := limitPolicy{count: count}
+		for _, parameter := range parts[1:] {
+			key, windowValue, ok := strings.Cut(strings.TrimSpace(parameter), "=")
+			if !ok || key != "w" {
+				continue
+			}
+			policy.window, err = strconv.Atoi(strings.TrimSpace(windowValue))
 			if err != nil {
-				return 0, 0, 0, 0, fmt.Errorf("failed to parse ratelimit-remaining window: %w", err)
+				return nil, fmt.Errorf("failed to parse %s window: %w", name, err)
 			}
+			policy.hasWindow = true
+		}
+		if requireWindow && !policy.hasWindow {
+			return nil, fmt.Errorf("%s header does not contain window information", name)
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// splitQuoted splits s on sep, except inside double-quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
 		}
-	} else {
-		return 0, 0, 0, 0, errors.New("ratelimit-remaining header does not contain window information")
 	}
-	return limitInt, limitWindow, remainingInt, remainingWindow, nil
+	return append(parts, s[start:])
 }
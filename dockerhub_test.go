@@ -1,12 +1,108 @@
 package main
 
 import (
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
+type fakeDockerHub struct {
+	server *httptest.Server
+	// probes counts the manifest requests received
+	probes atomic.Int32
+	// delay is applied to every manifest request
+	delay time.Duration
+	// inFlight and maxInFlight track concurrent manifest requests
+	inFlight    atomic.Int32
+	maxInFlight atomic.Int32
+	// tokenRejection makes the token endpoint answer 401 with these details
+	tokenRejection string
+	// anonymousFallback makes the token endpoint hand out anonymous tokens for
+	// credentials
+	anonymousFallback bool
+	// identity overrides the username the tokens are issued for
+	identity string
+}
+
+const fakeUserID = "6f3b2c1a-0d4e-4f5a-9b8c-7d6e5f4a3b2c"
+
+// fakeJWT returns an unsigned JWT with the claims Docker Hub sends.
+func fakeJWT(username string) string {
+	encode := func(value string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	claims := fmt.Sprintf(`{"sub":%q,"exp":1767225900,"https://auth.docker.io":{"username":%q}}`, fakeUserID, username)
+	return encode(`{"alg":"RS256","typ":"JWT"}`) + "." + encode(claims) + "." + encode("signature")
+}
+
+// newFakeDockerHub starts a local server answering token and manifest requests
+// and points tokenURL and limitsURL to it for the duration of the test.
+func newFakeDockerHub(t *testing.T, limit, remaining string) *fakeDockerHub {
+	t.Helper()
+	hub := &fakeDockerHub{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if hub.tokenRejection != "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = fmt.Fprintf(w, `{"details":%q}`, hub.tokenRejection)
+			return
+		}
+		token := "anonymous-token"
+		if username, _, ok := r.BasicAuth(); ok && !hub.anonymousFallback {
+			if hub.identity != "" {
+				username = hub.identity
+			}
+			token = fakeJWT(username)
+		}
+		_, _ = fmt.Fprintf(w, `{"token":%q,"expires_in":300,"issued_at":"2026-01-01T00:00:00Z"}`, token)
+	})
+	mux.HandleFunc("/v2/ratelimitpreview/test/manifests/latest", func(w http.ResponseWriter, r *http.Request) {
+		hub.probes.Add(1)
+		current := hub.inFlight.Add(1)
+		defer hub.inFlight.Add(-1)
+		for {
+			previous := hub.maxInFlight.Load()
+			if current <= previous || hub.maxInFlight.CompareAndSwap(previous, current) {
+				break
+			}
+		}
+		time.Sleep(hub.delay)
+		switch authorization := r.Header.Get("Authorization"); {
+		case strings.HasPrefix(authorization, "Bearer ey"):
+			w.Header().Set("docker-ratelimit-source", fakeUserID)
+		case authorization == "Bearer anonymous-token":
+			w.Header().Set("docker-ratelimit-source", "192.0.2.1")
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("ratelimit-limit", limit)
+		w.Header().Set("ratelimit-remaining", remaining)
+		w.WriteHeader(http.StatusOK)
+	})
+	hub.server = httptest.NewServer(mux)
+	t.Cleanup(hub.server.Close)
+
+	originalTokenURL, originalLimitsURL := tokenURL, limitsURL
+	tokenURL = hub.server.URL + "/token"
+	limitsURL = hub.server.URL + "/v2/ratelimitpreview/test/manifests/latest"
+	t.Cleanup(func() {
+		tokenURL, limitsURL = originalTokenURL, originalLimitsURL
+	})
+	return hub
+}
+
 func GetCredentialsFromEnv() (string, string) {
 	username := os.Getenv("DOCKERHUB_USERNAME")
 	password := os.Getenv("DOCKERHUB_PASSWORD")
@@ -22,7 +118,7 @@ func TestGetToken(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
-	if token == "" {
+	if token.token == "" {
 		t.Fatalf("Expected token to be non-empty, got empty string")
 	}
 }
@@ -35,17 +131,17 @@ func TestGetLimits(t *testing.T) {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 
-	limit, remaining, limitWindow, remainingWindow, source, err := getLimits(token, 10*time.Second)
+	l, err := getLimits(token.token, 10*time.Second)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
-	if limit == 0 || remaining == 0 || limitWindow == 0 || remainingWindow == 0 {
-		t.Fatalf("Expected limit and remaining to be non-zero, got %d and %d", limit, remaining)
+	if l.limit == 0 || l.remaining == 0 || l.limitWindow == 0 || l.remainingWindow == 0 {
+		t.Fatalf("Expected limit and remaining to be non-zero, got %d and %d", l.limit, l.remaining)
 	}
-	if source == "" {
+	if l.source == "" {
 		t.Fatalf("Expected source to be non-empty, got empty string")
 	}
-	t.Logf("Limit: %d, Remaining: %d, Source: %s", limit, remaining, source)
+	t.Logf("Limit: %d, Remaining: %d, Source: %s", l.limit, l.remaining, l.source)
 }
 
 func TestGetLimitsNoUser(t *testing.T) {
@@ -54,17 +150,17 @@ func TestGetLimitsNoUser(t *testing.T) {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 
-	limit, remaining, limitWindow, remainingWindow, source, err := getLimits(token, 10*time.Second)
+	l, err := getLimits(token.token, 10*time.Second)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
-	if limit == 0 || remaining == 0 || limitWindow == 0 || remainingWindow == 0 {
-		t.Fatalf("Expected limit and remaining to be non-zero, got %d and %d", limit, remaining)
+	if l.limit == 0 || l.remaining == 0 || l.limitWindow == 0 || l.remainingWindow == 0 {
+		t.Fatalf("Expected limit and remaining to be non-zero, got %d and %d", l.limit, l.remaining)
 	}
-	if source == "" {
+	if l.source == "" {
 		t.Fatalf("Expected source to be non-empty, got empty string")
 	}
-	t.Logf("Limit: %d, Remaining: %d, Source: %s", limit, remaining, source)
+	t.Logf("Limit: %d, Remaining: %d, Source: %s", l.limit, l.remaining, l.source)
 }
 
 func TestParseLimits(t *testing.T) {
@@ -138,6 +234,36 @@ func TestParseLimits(t *testing.T) {
 			expectedWindowRemaining: 0,
 			expectedError:           errors.New("failed to parse ratelimit-limit window: strconv.Atoi: parsing \"abc\": invalid syntax"),
 		},
+		{
+			name:                    "Burst and sustained policies",
+			limit:                   "200;w=21600, 40;w=600",
+			remaining:               "150;w=21600, 12;w=600",
+			expectedLimit:           40,
+			expectedWindowLimit:     600,
+			expectedRemaining:       12,
+			expectedWindowRemaining: 600,
+			expectedError:           nil,
+		},
+		{
+			name:                    "Extra parameters",
+			limit:                   `100;w=21600;comment="anonymous; per IP"`,
+			remaining:               `76;w=21600;comment="x"`,
+			expectedLimit:           100,
+			expectedWindowLimit:     21600,
+			expectedRemaining:       76,
+			expectedWindowRemaining: 21600,
+			expectedError:           nil,
+		},
+		{
+			name:                    "Policies that don't match",
+			limit:                   "200;w=21600, 40;w=600",
+			remaining:               "150;w=3600",
+			expectedLimit:           0,
+			expectedWindowLimit:     0,
+			expectedRemaining:       0,
+			expectedWindowRemaining: 0,
+			expectedError:           errors.New("ratelimit-remaining header does not match any policy of ratelimit-limit"),
+		},
 		{
 			name:                    "Invalid window in remaining",
 			limit:                   "100;w=60",
@@ -152,7 +278,8 @@ func TestParseLimits(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			limit, limitWindow, remaining, remainingWindow, err := parseLimits(tt.limit, tt.remaining)
+			l, err := parseLimits(tt.limit, tt.remaining)
+			limit, limitWindow, remaining, remainingWindow := l.limit, l.limitWindow, l.remaining, l.remainingWindow
 
 			if limit != tt.expectedLimit {
 				t.Errorf("expected limit %d, got %d", tt.expectedLimit, limit)
@@ -172,3 +299,258 @@ func TestParseLimits(t *testing.T) {
 		})
 	}
 }
+
+func TestParseLimitsReportsEveryWindow(t *testing.T) {
+	l, err := parseLimits("200;w=21600, 40;w=600", "150;w=21600, 12;w=600")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := []windowLimits{
+		{window: 21600, limit: 200, remaining: 150},
+		{window: 600, limit: 40, remaining: 12},
+	}
+	if !reflect.DeepEqual(l.windows, want) {
+		t.Errorf("expected windows %+v, got %+v", want, l.windows)
+	}
+}
+
+func TestParseTokenResponse(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		body          string
+		wantToken     string
+		wantExpiresAt time.Time
+		wantSubject   string
+		wantUsername  string
+		wantErr       bool
+	}{
+		{
+			name:          "When the expiry and issue time are sent then the expiry is computed from them",
+			body:          `{"token":"abc","expires_in":300,"issued_at":"2026-01-01T11:00:00Z"}`,
+			wantToken:     "abc",
+			wantExpiresAt: time.Date(2026, 1, 1, 11, 5, 0, 0, time.UTC),
+		},
+		{
+			name:          "When only the expiry is sent then it is relative to now",
+			body:          `{"access_token":"abc","expires_in":60}`,
+			wantToken:     "abc",
+			wantExpiresAt: now.Add(time.Minute),
+		},
+		{
+			name:      "When no expiry is sent then it is unknown",
+			body:      `{"token":"abc"}`,
+			wantToken: "abc",
+		},
+		{
+			name:          "When the token is a JWT then the expiry is read from its claims",
+			body:          fmt.Sprintf(`{"token":%q}`, fakeJWT("user1")),
+			wantToken:     fakeJWT("user1"),
+			wantExpiresAt: time.Date(2026, 1, 1, 0, 5, 0, 0, time.UTC),
+			wantSubject:   fakeUserID,
+			wantUsername:  "user1",
+		},
+		{
+			name:    "When no token is sent then it fails",
+			body:    `{"expires_in":60}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := parseTokenResponse([]byte(tt.body), now)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if token.token != tt.wantToken {
+				t.Errorf("expected token %q, got %q", tt.wantToken, token.token)
+			}
+			if !token.expiresAt.Equal(tt.wantExpiresAt) {
+				t.Errorf("expected expiry %v, got %v", tt.wantExpiresAt, token.expiresAt)
+			}
+			if token.subject != tt.wantSubject || token.username != tt.wantUsername {
+				t.Errorf("expected subject %q and username %q, got %q and %q", tt.wantSubject, tt.wantUsername, token.subject, token.username)
+			}
+		})
+	}
+}
+
+func TestCollectSeparatesAuthFailures(t *testing.T) {
+	hub := newFakeDockerHub(t, "100;w=21600", "42;w=21600")
+	hub.tokenRejection = "personal access token is expired"
+	credential := credentials{Username: "expired-token", Password: "dckr_pat_abc", TokenType: tokenTypePAT}
+	config := configuration{Credentials: []credentials{credential}, Timeout: time.Second}
+	failures := authFailuresCount.WithLabelValues("expired-token", "dockerhub")
+	before := testutil.ToFloat64(failures)
+
+	_, err := collect(credential, config)
+	if !errors.Is(err, errAuthFailed) {
+		t.Fatalf("expected an authentication failure, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "personal access token is expired") {
+		t.Errorf("expected the details of the rejection in the error, got %v", err)
+	}
+	if got := testutil.ToFloat64(failures) - before; got != 1 {
+		t.Errorf("expected 1 authentication failure, got %f", got)
+	}
+	if got := testutil.ToFloat64(errorsCount.WithLabelValues("expired-token", "dockerhub")); got != 0 {
+		t.Errorf("expected no exporter errors, got %f", got)
+	}
+}
+
+func TestCollectExportsTokenExpiry(t *testing.T) {
+	newFakeDockerHub(t, "100;w=21600", "42;w=21600")
+	credential := credentials{Username: "token-expiry", Password: "password"}
+	if _, err := collect(credential, configuration{Timeout: time.Second}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := float64(time.Date(2026, 1, 1, 0, 5, 0, 0, time.UTC).Unix())
+	if got := testutil.ToFloat64(tokenExpiryTimestamp.WithLabelValues("token-expiry", "dockerhub")); got != want {
+		t.Errorf("expected token expiry %f, got %f", want, got)
+	}
+}
+
+func TestCollectReportsUnlimitedAccounts(t *testing.T) {
+	newFakeDockerHub(t, "", "")
+	credential := credentials{Username: "unlimited", Password: "password"}
+	l, err := collect(credential, configuration{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !l.unlimited {
+		t.Fatalf("expected the account to be unlimited, got %+v", l)
+	}
+	if got := testutil.ToFloat64(unlimitedAccount.WithLabelValues("unlimited", "dockerhub")); got != 1 {
+		t.Errorf("expected dockerhub_pull_unlimited 1, got %f", got)
+	}
+	if got := pullLimit.DeletePartialMatch(prometheus.Labels{"account": "unlimited"}); got != 0 {
+		t.Errorf("expected no limit gauges for the unlimited account, got %d", got)
+	}
+	if got := testutil.ToFloat64(errorsCount.WithLabelValues("unlimited", "dockerhub")); got != 0 {
+		t.Errorf("expected no exporter errors, got %f", got)
+	}
+}
+
+func TestCollectDetectsAnonymousFallback(t *testing.T) {
+	hub := newFakeDockerHub(t, "100;w=21600", "42;w=21600")
+	hub.anonymousFallback = true
+	credential := credentials{Username: "locked", Password: "dckr_pat_abc", TokenType: tokenTypePAT}
+	fallbacks := anonymousFallbackCount.WithLabelValues("locked", "dockerhub")
+	before := testutil.ToFloat64(fallbacks)
+
+	_, err := collect(credential, configuration{Timeout: time.Second})
+	if !errors.Is(err, errAnonymousFallback) {
+		t.Fatalf("expected an anonymous fallback, got %v", err)
+	}
+	if got := testutil.ToFloat64(fallbacks) - before; got != 1 {
+		t.Errorf("expected 1 anonymous fallback, got %f", got)
+	}
+	if got := testutil.ToFloat64(errorsCount.WithLabelValues("locked", "dockerhub")); got != 0 {
+		t.Errorf("expected no exporter errors, got %f", got)
+	}
+	if got := pullRemaining.DeletePartialMatch(prometheus.Labels{"account": "locked"}); got != 0 {
+		t.Errorf("expected no limits under the named account, got %d series", got)
+	}
+}
+
+func TestCheckSource(t *testing.T) {
+	tests := []struct {
+		name       string
+		credential credentials
+		source     string
+		wantErr    bool
+	}{
+		{
+			name:       "When a named credential gets a user ID then it matches",
+			credential: credentials{Username: "user1", Password: "password1"},
+			source:     fakeUserID,
+		},
+		{
+			name:       "When a named credential gets an IPv4 address then it fell back to anonymous",
+			credential: credentials{Username: "user1", Password: "password1"},
+			source:     "192.0.2.1",
+			wantErr:    true,
+		},
+		{
+			name:       "When a named credential gets an IPv6 address then it fell back to anonymous",
+			credential: credentials{Username: "user1", Password: "password1"},
+			source:     "2001:db8::1",
+			wantErr:    true,
+		},
+		{
+			name:       "When an anonymous credential gets an IP address then it matches",
+			credential: credentials{Anonymous: true},
+			source:     "192.0.2.1",
+		},
+		{
+			name:       "When the registry reports no source then it matches",
+			credential: credentials{Username: "user1", Password: "password1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSource(tt.credential, tt.source)
+			if tt.wantErr != (err != nil) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCollectChecksTokenIdentity(t *testing.T) {
+	tests := []struct {
+		name       string
+		identity   string
+		credential credentials
+		wantErr    bool
+	}{
+		{
+			name:       "When the token is issued for the configured user then the user ID is exported",
+			credential: credentials{Username: "identity-user", Password: "password"},
+		},
+		{
+			name:       "When the username differs in case then it matches",
+			identity:   "Identity-User",
+			credential: credentials{Username: "identity-user", Password: "password"},
+		},
+		{
+			name:       "When the token is issued for another user then it fails",
+			identity:   "someone-else",
+			credential: credentials{Username: "identity-user", Password: "password"},
+			wantErr:    true,
+		},
+		{
+			name:       "When an organization access token is used then the identity is not checked",
+			identity:   "org-owner",
+			credential: credentials{Username: "identity-org", Password: "dckr_oat_abc", TokenType: tokenTypeOAT},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := newFakeDockerHub(t, "100;w=21600", "42;w=21600")
+			hub.identity = tt.identity
+			l, err := collect(tt.credential, configuration{Timeout: time.Second})
+			if tt.wantErr {
+				if !errors.Is(err, errAuthFailed) {
+					t.Fatalf("expected an authentication failure, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if l.userID != fakeUserID {
+				t.Errorf("expected user ID %q, got %q", fakeUserID, l.userID)
+			}
+			if got := testutil.ToFloat64(accountInfo.WithLabelValues(tt.credential.Username, "dockerhub", fakeUserID)); got != 1 {
+				t.Errorf("expected account info 1, got %f", got)
+			}
+		})
+	}
+}
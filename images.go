@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// registryDomains maps the domains of Docker Hub to its name in the registry
+// label. Other registries are labelled with their domain.
+var registryDomains = map[string]string{
+	"docker.io":            dockerHubRegistry,
+	"index.docker.io":      dockerHubRegistry,
+	"registry-1.docker.io": dockerHubRegistry,
+}
+
+// parseImageReference splits an image reference such as nginx:latest or
+// ghcr.io/org/app@sha256:... into its registry and repository, following the
+// normalization rules of Docker: references without a registry domain are
+// pulled from Docker Hub, and official images live under library/.
+func parseImageReference(reference string) (string, string) {
+	name := reference
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+
+	domain := "docker.io"
+	if first, rest, ok := strings.Cut(name, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		domain, name = first, rest
+	}
+	registry, ok := registryDomains[domain]
+	if !ok {
+		registry = domain
+	}
+	if registry == dockerHubRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return registry, name
+}
+
+// normalizeImageReference returns the registry and repository of a reference
+// as parseImageReference does, followed by its digest, or by its tag which
+// defaults to latest, so references to the same image can be compared.
+func normalizeImageReference(reference string) string {
+	registry, image := parseImageReference(reference)
+	if _, digest, ok := strings.Cut(reference, "@"); ok {
+		return registry + "/" + image + "@" + digest
+	}
+	if i := strings.LastIndex(reference, ":"); i > strings.LastIndex(reference, "/") {
+		return registry + "/" + image + reference[i:]
+	}
+	return registry + "/" + image + ":latest"
+}
+
+// countImagePull counts a pull of reference seen by the container runtime of
+// node. containerdNamespace is the containerd namespace of the image, k8s.io
+// for every pull of the kubelet, and namespace the Kubernetes namespace of the
+// pod it was pulled for. Both are empty when unknown.
+func countImagePull(reference string, containerdNamespace string, namespace string, node string) {
+	registry, image := parseImageReference(reference)
+	log.WithFields(log.Fields{
+		"image":                image,
+		"registry":             registry,
+		"containerd_namespace": containerdNamespace,
+		"namespace":            namespace,
+		"node":                 node,
+	}).Debug("Image pulled")
+	imagePulls.WithLabelValues(image, registry, containerdNamespace, namespace, node).Inc()
+}
+
+// nodeName returns the configured node name, or the NODE_NAME environment
+// variable, usually set from the downward API in a DaemonSet, or the hostname.
+func nodeName(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		return node
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return hostname
+}
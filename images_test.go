@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		reference    string
+		wantRegistry string
+		wantImage    string
+	}{
+		{reference: "nginx", wantRegistry: "dockerhub", wantImage: "library/nginx"},
+		{reference: "nginx:latest", wantRegistry: "dockerhub", wantImage: "library/nginx"},
+		{reference: "docker.io/grafana/grafana:11.0.0", wantRegistry: "dockerhub", wantImage: "grafana/grafana"},
+		{reference: "grafana/grafana@sha256:0123", wantRegistry: "dockerhub", wantImage: "grafana/grafana"},
+		{reference: "ghcr.io/org/app:v1", wantRegistry: "ghcr.io", wantImage: "org/app"},
+		{reference: "quay.io/prometheus/node-exporter", wantRegistry: "quay.io", wantImage: "prometheus/node-exporter"},
+		{reference: "localhost:5000/app:dev", wantRegistry: "localhost:5000", wantImage: "app"},
+		{reference: "registry.example.com/team/app:1.0@sha256:0123", wantRegistry: "registry.example.com", wantImage: "team/app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reference, func(t *testing.T) {
+			registry, image := parseImageReference(tt.reference)
+			if registry != tt.wantRegistry || image != tt.wantImage {
+				t.Errorf("expected %s %s, got %s %s", tt.wantRegistry, tt.wantImage, registry, image)
+			}
+		})
+	}
+}
+
+func TestNormalizeImageReference(t *testing.T) {
+	tests := map[string]string{
+		"nginx":                           "dockerhub/library/nginx:latest",
+		"nginx:1.25":                      "dockerhub/library/nginx:1.25",
+		"docker.io/library/nginx:1.25":    "dockerhub/library/nginx:1.25",
+		"grafana/grafana@sha256:0123":     "dockerhub/grafana/grafana@sha256:0123",
+		"ghcr.io/org/app:v1@sha256:0123":  "ghcr.io/org/app@sha256:0123",
+		"localhost:5000/app":              "localhost:5000/app:latest",
+		"registry.example.com:5000/app:1": "registry.example.com:5000/app:1",
+	}
+	for reference, want := range tests {
+		if got := normalizeImageReference(reference); got != want {
+			t.Errorf("expected %s for %s, got %s", want, reference, got)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+type kubernetesEventsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Namespace restricts the events watched to a namespace, all of them when
+	// empty.
+	Namespace string `yaml:"namespace"`
+	// RetryInterval is how long to wait before watching again when the watch
+	// ends.
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+// pulledImagePattern extracts the image from the message of the kubelet's
+// Failed events, such as
+//
+//	Failed to pull image "nginx:latest": ... toomanyrequests: You have reached your pull rate limit.
+var pulledImagePattern = regexp.MustCompile(`image "([^"]+)"`)
+
+// kubernetesEventsWatcher counts the image pulls that Kubernetes reported as
+// failed because of the Docker Hub rate limit. A nil kubernetesEventsWatcher
+// does nothing.
+type kubernetesEventsWatcher struct {
+	config kubernetesEventsConfig
+	client kubernetes.Interface
+	// counts is the number of occurrences already counted for every event,
+	// which the kubelet updates instead of emitting the same event again.
+	counts map[types.UID]int32
+	// synced is set once the events that existed at startup were listed.
+	synced bool
+}
+
+func newKubernetesEventsWatcher(config configuration) (*kubernetesEventsWatcher, error) {
+	if !config.KubernetesEvents.Enabled {
+		return nil, nil
+	}
+	eventsConfig := config.KubernetesEvents
+	if eventsConfig.RetryInterval == 0 {
+		eventsConfig.RetryInterval = 5 * time.Second
+	}
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &kubernetesEventsWatcher{config: eventsConfig, client: client, counts: map[types.UID]int32{}}, nil
+}
+
+// start watches the events until ctx is done. The events that already exist
+// when it starts are not counted.
+func (w *kubernetesEventsWatcher) start(ctx context.Context) {
+	if w == nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"namespace": w.config.Namespace,
+	}).Info("Watching Kubernetes events for Docker Hub rate limit failures")
+	go func() {
+		for {
+			err := w.watch(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warnf("Kubernetes event watch ended, watching again: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.config.RetryInterval):
+			}
+		}
+	}()
+}
+
+// watch lists the failed events and then follows their changes. The events
+// listed the first time happened before the exporter started and are only
+// remembered, while the ones listed again after a watch ended are counted.
+func (w *kubernetesEventsWatcher) watch(ctx context.Context) error {
+	events := w.client.CoreV1().Events(w.config.Namespace)
+	options := metav1.ListOptions{FieldSelector: "reason=Failed"}
+	list, err := events.List(ctx, options)
+	if err != nil {
+		return fmt.Errorf("failed to list events: %w", err)
+	}
+	for i := range list.Items {
+		if !w.synced {
+			w.counts[list.Items[i].UID] = eventCount(&list.Items[i])
+			continue
+		}
+		w.observe(&list.Items[i])
+	}
+	w.synced = true
+
+	options.ResourceVersion = list.ResourceVersion
+	watcher, err := events.Watch(ctx, options)
+	if err != nil {
+		return fmt.Errorf("failed to watch events: %w", err)
+	}
+	defer watcher.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case change, ok := <-watcher.ResultChan():
+			if !ok {
+				return errors.New("watch closed by the API server")
+			}
+			event, ok := change.Object.(*corev1.Event)
+			if !ok {
+				continue
+			}
+			switch change.Type {
+			case watch.Added, watch.Modified:
+				w.observe(event)
+			case watch.Deleted:
+				delete(w.counts, event.UID)
+			}
+		}
+	}
+}
+
+// observe counts the new occurrences of a Docker Hub rate limit failure.
+func (w *kubernetesEventsWatcher) observe(event *corev1.Event) {
+	count := eventCount(event)
+	previous := w.counts[event.UID]
+	w.counts[event.UID] = count
+	if count <= previous || !dockerHubRateLimited(event.Message) {
+		return
+	}
+	match := pulledImagePattern.FindStringSubmatch(event.Message)
+	if match == nil {
+		return
+	}
+	registry, image := parseImageReference(match[1])
+	if registry != dockerHubRegistry {
+		return
+	}
+	node := event.Source.Host
+	if node == "" {
+		node = event.ReportingInstance
+	}
+	log.WithFields(log.Fields{
+		"namespace": event.Namespace,
+		"image":     image,
+		"node":      node,
+		"pod":       event.InvolvedObject.Name,
+	}).Warn("Image pull was throttled by the Docker Hub rate limit")
+	throttledEvents.WithLabelValues(event.Namespace, image, node).Add(float64(count - previous))
+}
+
+// eventCount returns how many times the event happened.
+func eventCount(event *corev1.Event) int32 {
+	count := event.Count
+	if event.Series != nil && event.Series.Count > count {
+		count = event.Series.Count
+	}
+	if count < 1 {
+		count = 1
+	}
+	return count
+}
+
+// dockerHubRateLimited reports whether a pull failed because of the Docker Hub
+// rate limit.
+func dockerHubRateLimited(message string) bool {
+	message = strings.ToLower(message)
+	return strings.Contains(message, "toomanyrequests") || strings.Contains(message, "reached your pull rate limit")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func throttledMessage(image string) string {
+	return fmt.Sprintf(`Failed to pull image "%s": failed to pull and unpack image "%s": 429 Too Many Requests - `+
+		`Server message: toomanyrequests: You have reached your pull rate limit. You may increase the limit by `+
+		`authenticating and upgrading: https://www.docker.com/increase-rate-limit`, image, image)
+}
+
+func newFailedEvent(name, namespace, node, message string, count int32) *corev1.Event {
+	return &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: name, Namespace: namespace, UID: types.UID(name)},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: name, Namespace: namespace},
+		Reason:         "Failed",
+		Message:        message,
+		Source:         corev1.EventSource{Component: "kubelet", Host: node},
+		Count:          count,
+	}
+}
+
+func TestKubernetesEventsWatcher(t *testing.T) {
+	client := fake.NewClientset(newFailedEvent("before-start", "ci", "node1", throttledMessage("postgres:16"), 3))
+	watching := make(chan struct{}, 10)
+	client.PrependWatchReactor("events", func(k8stesting.Action) (bool, watch.Interface, error) {
+		watching <- struct{}{}
+		return false, nil, nil
+	})
+	watcher := &kubernetesEventsWatcher{
+		config: kubernetesEventsConfig{RetryInterval: time.Hour},
+		client: client,
+		counts: map[types.UID]int32{},
+	}
+
+	redis := throttledEvents.WithLabelValues("ci", "library/redis", "node1")
+	postgres := throttledEvents.WithLabelValues("ci", "library/postgres", "node1")
+	app := throttledEvents.WithLabelValues("ci", "org/app", "node1")
+	redisBefore, postgresBefore, appBefore := testutil.ToFloat64(redis), testutil.ToFloat64(postgres), testutil.ToFloat64(app)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = watcher.watch(ctx) }()
+	select {
+	case <-watching:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the watcher to watch events")
+	}
+
+	events := client.CoreV1().Events("ci")
+	created := []*corev1.Event{
+		newFailedEvent("throttled", "ci", "node1", throttledMessage("redis:7"), 1),
+		newFailedEvent("other-error", "ci", "node1", `Failed to pull image "redis:8": not found`, 1),
+		newFailedEvent("other-registry", "ci", "node1", throttledMessage("ghcr.io/org/app:v1"), 1),
+	}
+	for _, event := range created {
+		if _, err := events.Create(ctx, event, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	// The kubelet reports further failures by increasing the count.
+	updated := created[0].DeepCopy()
+	updated.Count = 4
+	if _, err := events.Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	waitFor(t, 5*time.Second, func() bool {
+		return testutil.ToFloat64(redis)-redisBefore == 4
+	})
+	if got := testutil.ToFloat64(postgres) - postgresBefore; got != 0 {
+		t.Errorf("expected the events from before the start to be ignored, got %f", got)
+	}
+	if got := testutil.ToFloat64(app) - appBefore; got != 0 {
+		t.Errorf("expected the rate limits of other registries to be ignored, got %f", got)
+	}
+}
+
+func TestKubernetesEventsWatcherCountsEventsMissedBetweenWatches(t *testing.T) {
+	client := fake.NewClientset()
+	watcher := &kubernetesEventsWatcher{client: client, counts: map[types.UID]int32{}}
+	ended := watch.NewFake()
+	client.PrependWatchReactor("events", func(k8stesting.Action) (bool, watch.Interface, error) {
+		return true, ended, nil
+	})
+
+	alpine := throttledEvents.WithLabelValues("builds", "library/alpine", "node2")
+	before := testutil.ToFloat64(alpine)
+
+	ended.Stop()
+	if err := watcher.watch(context.Background()); err == nil {
+		t.Fatal("expected the closed watch to end with an error")
+	}
+	missed := newFailedEvent("missed", "builds", "node2", throttledMessage("docker.io/library/alpine:3"), 2)
+	if err := client.Tracker().Add(missed); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ended = watch.NewFake()
+	ended.Stop()
+	_ = watcher.watch(context.Background())
+
+	if got := testutil.ToFloat64(alpine) - before; got != 2 {
+		t.Errorf("expected the 2 failures of the missed event to be counted, got %f", got)
+	}
+}
+
+func TestKubernetesEventsWatcherDisabled(t *testing.T) {
+	watcher, err := newKubernetesEventsWatcher(configuration{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if watcher != nil {
+		t.Fatal("expected no watcher when disabled")
+	}
+	watcher.start(context.Background())
+}
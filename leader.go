@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/flock"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+const (
+	followerModeCache    = "cache"
+	followerModeNotReady = "not_ready"
+)
+
+type leaderElectionConfig struct {
+	// Backend is either kubernetes, to use a coordination Lease, or file, to use
+	// a lock file shared by the replicas.
+	Backend        string `yaml:"backend"`
+	LeaseName      string `yaml:"lease_name"`
+	LeaseNamespace string `yaml:"lease_namespace"`
+	LockFile       string `yaml:"lock_file"`
+	// Identity names this replica. In cache mode followers fetch the state from
+	// http://<identity of the leader> unless leader_url is set, so an address
+	// like $(POD_IP):9101 works best.
+	Identity     string `yaml:"identity"`
+	FollowerMode string `yaml:"follower_mode"`
+	LeaderURL    string `yaml:"leader_url"`
+}
+
+// leaderElector makes sure only one replica probes Docker Hub. Followers either
+// serve a copy of the leader's state or report not ready. A nil leaderElector
+// means leader election is disabled and the replica is always the leader.
+type leaderElector struct {
+	config   leaderElectionConfig
+	identity string
+	timeout  time.Duration
+
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+
+	client kubernetes.Interface
+
+	mutex  sync.Mutex
+	leader bool
+	holder string
+	synced bool
+}
+
+func newLeaderElector(config configuration) (*leaderElector, error) {
+	if config.LeaderElection.Backend == "" {
+		return nil, nil
+	}
+	electionConfig := config.LeaderElection
+	if electionConfig.FollowerMode == "" {
+		electionConfig.FollowerMode = followerModeCache
+	}
+	if electionConfig.FollowerMode != followerModeCache && electionConfig.FollowerMode != followerModeNotReady {
+		return nil, fmt.Errorf("unsupported follower mode %q", electionConfig.FollowerMode)
+	}
+
+	identity := electionConfig.Identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		identity = hostname
+	}
+
+	// A new leader takes over at most leaseDuration + retryPeriod after the
+	// previous one stopped renewing, which keeps failover within update_interval.
+	e := &leaderElector{
+		config:        electionConfig,
+		identity:      identity,
+		timeout:       config.Timeout,
+		leaseDuration: config.UpdateInterval / 2,
+		renewDeadline: config.UpdateInterval / 3,
+		retryPeriod:   config.UpdateInterval / 6,
+	}
+
+	switch electionConfig.Backend {
+	case "kubernetes":
+		if e.config.LeaseName == "" {
+			e.config.LeaseName = "dockerhub-pull-limit-exporter"
+		}
+		if e.config.LeaseNamespace == "" {
+			namespace, err := os.ReadFile(namespaceFile)
+			if err != nil {
+				return nil, fmt.Errorf("lease namespace must be set outside of a cluster: %w", err)
+			}
+			e.config.LeaseNamespace = strings.TrimSpace(string(namespace))
+		}
+		restConfig, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, err
+		}
+		e.client, err = kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return nil, err
+		}
+	case "file":
+		if e.config.LockFile == "" {
+			return nil, fmt.Errorf("lock file must be set")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported leader election backend %q", electionConfig.Backend)
+	}
+	return e, nil
+}
+
+// run takes part in the election until ctx is done. lead is called with a
+// context that is cancelled when the leadership is lost.
+func (e *leaderElector) run(ctx context.Context, lead func(ctx context.Context)) {
+	if e.config.FollowerMode == followerModeCache {
+		go e.syncFromLeader(ctx)
+	}
+	if e.config.Backend == "file" {
+		go e.runFileLock(ctx, lead)
+	} else {
+		go e.runLease(ctx, lead)
+	}
+}
+
+func (e *leaderElector) runLease(ctx context.Context, lead func(ctx context.Context)) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      e.config.LeaseName,
+			Namespace: e.config.LeaseNamespace,
+		},
+		Client:     e.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: e.identity},
+	}
+	// RunOrDie returns when the leadership is lost, so keep running for the
+	// chance to be elected again.
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   e.leaseDuration,
+			RenewDeadline:   e.renewDeadline,
+			RetryPeriod:     e.retryPeriod,
+			Name:            e.config.LeaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					e.setLeader(true)
+					lead(ctx)
+				},
+				OnStoppedLeading: func() {
+					e.setLeader(false)
+				},
+				OnNewLeader: e.setHolder,
+			},
+		})
+	}
+}
+
+// runFileLock holds the leadership for as long as it holds the lock file. The
+// identity of the leader is written next to it so followers can find it.
+func (e *leaderElector) runFileLock(ctx context.Context, lead func(ctx context.Context)) {
+	lock := flock.New(e.config.LockFile)
+	ticker := time.NewTicker(e.retryPeriod)
+	defer ticker.Stop()
+	for {
+		locked, err := lock.TryLock()
+		if err != nil {
+			log.Errorf("Failed to acquire lock file %s: %v", e.config.LockFile, err)
+		}
+		if locked {
+			break
+		}
+		if holder, err := os.ReadFile(e.holderFile()); err == nil {
+			e.setHolder(strings.TrimSpace(string(holder)))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	if err := os.WriteFile(e.holderFile(), []byte(e.identity), 0644); err != nil {
+		log.Errorf("Failed to write identity to %s: %v", e.holderFile(), err)
+	}
+	e.setHolder(e.identity)
+	e.setLeader(true)
+	lead(ctx)
+	<-ctx.Done()
+	e.setLeader(false)
+	if err := lock.Unlock(); err != nil {
+		log.Errorf("Failed to release lock file %s: %v", e.config.LockFile, err)
+	}
+}
+
+func (e *leaderElector) holderFile() string {
+	return e.config.LockFile + ".leader"
+}
+
+func (e *leaderElector) setLeader(leader bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if leader != e.leader {
+		log.WithFields(log.Fields{
+			"identity": e.identity,
+		}).Infof("Leadership changed, leader: %v", leader)
+	}
+	e.leader = leader
+}
+
+func (e *leaderElector) setHolder(holder string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.holder = holder
+}
+
+func (e *leaderElector) isLeader() bool {
+	if e == nil {
+		return true
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.leader
+}
+
+// ready reports whether this replica can serve metrics: the leader always can,
+// followers only in cache mode once they fetched the leader's state.
+func (e *leaderElector) ready() bool {
+	if e == nil {
+		return true
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.leader {
+		return true
+	}
+	return e.config.FollowerMode == followerModeCache && e.synced
+}
+
+// syncFromLeader copies the leader's state while this replica is a follower.
+func (e *leaderElector) syncFromLeader(ctx context.Context) {
+	ticker := time.NewTicker(e.retryPeriod)
+	defer ticker.Stop()
+	for {
+		if !e.isLeader() {
+			if err := e.fetchLeaderState(); err != nil {
+				log.Debugf("Failed to fetch the state from the leader: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *leaderElector) fetchLeaderState() error {
+	e.mutex.Lock()
+	url := e.config.LeaderURL
+	if url == "" && e.holder != "" && e.holder != e.identity {
+		url = "http://" + e.holder
+	}
+	e.mutex.Unlock()
+	if url == "" {
+		return fmt.Errorf("leader is unknown")
+	}
+
+	client := &http.Client{Timeout: e.timeout}
+	resp, err := client.Get(strings.TrimSuffix(url, "/") + "/api/v1/state")
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Errorf("Error closing response body: %v", err)
+		}
+	}(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch state: status code %d", resp.StatusCode)
+	}
+
+	var accounts []accountState
+	if err := json.NewDecoder(resp.Body).Decode(&accounts); err != nil {
+		return err
+	}
+	if e.isLeader() {
+		return nil
+	}
+	restoreState(accounts)
+
+	e.mutex.Lock()
+	e.synced = true
+	e.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestElector(t *testing.T, backend string, identity string, lockFile string, updateInterval time.Duration) *leaderElector {
+	t.Helper()
+	config := configuration{
+		UpdateInterval: updateInterval,
+		Timeout:        time.Second,
+		LeaderElection: leaderElectionConfig{
+			Backend:      "file",
+			LockFile:     lockFile,
+			Identity:     identity,
+			FollowerMode: followerModeNotReady,
+		},
+	}
+	e, err := newLeaderElector(config)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	e.config.Backend = backend
+	return e
+}
+
+func waitFor(t *testing.T, timeout time.Duration, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileLeaderElection(t *testing.T) {
+	lockFile := filepath.Join(t.TempDir(), "leader.lock")
+	first := newTestElector(t, "file", "first", lockFile, 600*time.Millisecond)
+	second := newTestElector(t, "file", "second", lockFile, 600*time.Millisecond)
+
+	var firstLeading, secondLeading atomic.Bool
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	defer stopFirst()
+	secondCtx, stopSecond := context.WithCancel(context.Background())
+	defer stopSecond()
+
+	first.run(firstCtx, func(ctx context.Context) { firstLeading.Store(true) })
+	waitFor(t, time.Second, first.isLeader)
+	second.run(secondCtx, func(ctx context.Context) { secondLeading.Store(true) })
+
+	waitFor(t, time.Second, func() bool {
+		second.mutex.Lock()
+		defer second.mutex.Unlock()
+		return second.holder == "first"
+	})
+	if second.isLeader() || secondLeading.Load() {
+		t.Fatal("expected only one leader")
+	}
+	if second.ready() {
+		t.Error("expected the follower not to be ready in not_ready mode")
+	}
+	if !firstLeading.Load() || !first.ready() {
+		t.Error("expected the leader to collect and be ready")
+	}
+
+	stopFirst()
+	// Failover must happen within one update interval.
+	waitFor(t, 600*time.Millisecond, second.isLeader)
+	if !secondLeading.Load() {
+		t.Error("expected the new leader to start collecting")
+	}
+}
+
+func TestLeaseLeaderElection(t *testing.T) {
+	client := fake.NewClientset()
+	e := newTestElector(t, "kubernetes", "replica-0", filepath.Join(t.TempDir(), "unused.lock"), 6*time.Second)
+	e.client = client
+	e.config.LeaseName = "dockerhub-pull-limit-exporter"
+	e.config.LeaseNamespace = "monitoring"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var leading atomic.Bool
+	e.run(ctx, func(ctx context.Context) { leading.Store(true) })
+
+	waitFor(t, 5*time.Second, e.isLeader)
+	if !leading.Load() {
+		t.Error("expected the leader to start collecting")
+	}
+	lease, err := client.CoordinationV1().Leases("monitoring").Get(context.Background(), "dockerhub-pull-limit-exporter", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the lease to be created, got %v", err)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != "replica-0" {
+		t.Errorf("expected the lease to be held by replica-0, got %v", lease.Spec.HolderIdentity)
+	}
+}
+
+func TestFollowerServesLeaderState(t *testing.T) {
+	state.record("leader-user", limits{limit: 100, remaining: 42, source: "192.0.2.1"}, time.Now())
+	leader := httptest.NewServer(http.HandlerFunc(stateHandler))
+	defer leader.Close()
+
+	e := newTestElector(t, "file", "follower", filepath.Join(t.TempDir(), "leader.lock"), time.Minute)
+	e.config.FollowerMode = followerModeCache
+	e.config.LeaderURL = leader.URL
+
+	if e.ready() {
+		t.Fatal("expected the follower not to be ready before syncing")
+	}
+	if err := e.fetchLeaderState(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !e.ready() {
+		t.Error("expected the follower to be ready after syncing")
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	readyHandler(func() bool { return false })(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+	var disabled *leaderElector
+	recorder = httptest.NewRecorder()
+	readyHandler(disabled.ready)(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+}
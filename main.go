@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -23,12 +28,14 @@ func main() {
 	var logLevel string
 	var version bool
 	var healthcheck bool
+	var once bool
 
 	flag.IntVar(&port, "port", 9101, "Port to listen on")
 	flag.StringVar(&configFile, "config", "config.yaml", "Path to config file")
 	flag.StringVar(&logLevel, "loglevel", "info", "Log level")
 	flag.BoolVar(&version, "version", false, "prints version and exits")
 	flag.BoolVar(&healthcheck, "healthcheck", false, "performs a healthcheck to the running service and exits")
+	flag.BoolVar(&once, "once", false, "collects the metrics once, pushes them if configured and exits")
 	flag.Parse()
 
 	err := configureLogs(logLevel)
@@ -59,61 +66,312 @@ func main() {
 		log.Fatalf("Failed to get config: %v", err)
 	}
 
-	for _, credential := range config.Credentials {
-		log.WithFields(log.Fields{
-			"username": credential.Username,
-		}).Info("Starting metrics collector")
-		ticker := time.NewTicker(config.UpdateInterval)
-
-		go func() {
-			for ; true; <-ticker.C {
-				log.WithFields(log.Fields{
-					"username": credential.Username,
-				}).Debug("Collecting metrics")
-				err := collectMetrics(credential, config.Timeout, config.AnonymousAlias)
-				if err != nil {
-					log.WithFields(log.Fields{
-						"username": credential.Username,
-					}).Error(err)
-					errorsCount.WithLabelValues(credential.Username).Inc()
-				} else {
-					log.WithFields(log.Fields{
-						"username": credential.Username,
-					}).Debug("Successfully collected metrics")
-				}
+	if err := configureRegistries(config.Registries); err != nil {
+		log.Fatalf("Failed to configure registries: %v", err)
+	}
+
+	pusher, err := newMetricsPusher(config)
+	if err != nil {
+		log.Fatalf("Failed to configure the Pushgateway: %v", err)
+	}
+
+	otlp, err := newOTLPExporter(config)
+	if err != nil {
+		log.Fatalf("Failed to configure the OTLP exporter: %v", err)
+	}
+
+	writer, err := newRemoteWriter(config)
+	if err != nil {
+		log.Fatalf("Failed to configure remote write: %v", err)
+	}
+	writer.start()
+
+	alerts, err := newAlerter(config)
+	if err != nil {
+		log.Fatalf("Failed to configure alerts: %v", err)
+	}
+	alerts.start()
+	notify := func(credential credentials, l limits, err error) {
+		alerts.observe(credential, l, err, time.Now())
+	}
+
+	elector, err := newLeaderElector(config)
+	if err != nil {
+		log.Fatalf("Failed to configure leader election: %v", err)
+	}
+
+	events, err := newDockerEventsWatcher(config)
+	if err != nil {
+		log.Fatalf("Failed to configure the Docker events watcher: %v", err)
+	}
+
+	containerdEvents, err := newContainerdEventsWatcher(config)
+	if err != nil {
+		log.Fatalf("Failed to configure the containerd events watcher: %v", err)
+	}
+
+	kubernetesEvents, err := newKubernetesEventsWatcher(config)
+	if err != nil {
+		log.Fatalf("Failed to configure the Kubernetes events watcher: %v", err)
+	}
+
+	proxy, err := newPullProxy(config)
+	if err != nil {
+		log.Fatalf("Failed to configure the pull proxy: %v", err)
+	}
+
+	registryLogs, err := newRegistryLogTailer(config)
+	if err != nil {
+		log.Fatalf("Failed to configure the registry logs: %v", err)
+	}
+
+	broker, err := newCredentialBroker(config)
+	if err != nil {
+		log.Fatalf("Failed to configure the credential broker: %v", err)
+	}
+
+	if once {
+		if config.StateFile != "" {
+			restoreStateFile(config.StateFile)
+		}
+		ok := collectAll(config, notify)
+		alerts.wait()
+		pusher.push()
+		writer.enqueue()
+		writer.shutdown()
+		otlp.shutdown()
+		if config.StateFile != "" {
+			if err := saveState(config.StateFile, state.snapshot()); err != nil {
+				log.Errorf("Failed to save state file %s: %v", config.StateFile, err)
 			}
-		}()
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
 	}
 
-	if err := startMetricsServer(port); err != nil {
+	if config.StateFile != "" {
+		startStateWriter(config.StateFile, config.StateSaveInterval)
+	}
+	go handleShutdown(func() {
+		if config.StateFile != "" {
+			if err := saveState(config.StateFile, state.snapshot()); err != nil {
+				log.Errorf("Failed to save state file %s: %v", config.StateFile, err)
+			}
+		}
+	}, pusher.shutdown, writer.shutdown, otlp.shutdown)
+
+	// Every replica watches its own daemon, so the events are followed
+	// regardless of leadership.
+	events.start(context.Background())
+	containerdEvents.start(context.Background())
+	kubernetesEvents.start(context.Background())
+	proxy.start()
+	broker.start()
+	registryLogs.start(context.Background())
+
+	registerPoolCollector(config)
+
+	if config.ProbeOnly {
+		log.Info("Probe only mode enabled, metrics will be collected on /probe requests")
+	} else if config.CollectOnScrape {
+		log.Info("Collect on scrape mode enabled, metrics will be collected on /metrics requests")
+		registerLimitsCollector(config)
+	} else {
+		lead := func(ctx context.Context) {
+			startCollectors(ctx, config, notify, func() {
+				pusher.push()
+				writer.enqueue()
+			})
+		}
+		if elector != nil {
+			elector.run(context.Background(), lead)
+		} else {
+			lead(context.Background())
+		}
+	}
+
+	if err := startMetricsServer(port, config, elector.ready); err != nil {
 		log.Fatalf("Failed to start metrics server: %v", err)
 	}
 }
 
-func collectMetrics(credential credentials, timeout time.Duration, anonymousAlias string) error {
-	token, err := getToken(credential.Username, credential.Password, timeout)
+// collectHook is called after every collection with its result.
+type collectHook func(credential credentials, l limits, err error)
+
+// startCollectors schedules the collection of every credential until ctx is
+// done. afterCollect runs after every collection, whether it succeeded or not,
+// and afterCycle once every credential has been collected.
+func startCollectors(ctx context.Context, config configuration, afterCollect collectHook, afterCycle func()) {
+	newScheduler(config, afterCollect, afterCycle).run(ctx)
+}
+
+// collectAll collects the metrics of every credential once and reports whether
+// all of them succeeded.
+func collectAll(config configuration, afterCollect collectHook) bool {
+	ok := true
+	for _, credential := range config.Credentials {
+		l, err := collect(credential, config)
+		if err != nil {
+			ok = false
+		}
+		afterCollect(credential, l, err)
+	}
+	return ok
+}
+
+func collect(credential credentials, config configuration) (limits, error) {
+	log.WithFields(log.Fields{
+		"username": credential.Username,
+	}).Debug("Collecting metrics")
+	l, err := collectMetrics(credential, config.Timeout, config.AnonymousAlias)
 	if err != nil {
-		return err
+		recordCollectError(credential, err)
+		return limits{}, err
+	}
+	log.WithFields(log.Fields{
+		"username": credential.Username,
+	}).Debug("Successfully collected metrics")
+	return l, nil
+}
+
+// recordCollectError logs a failed collection and counts it either as an
+// authentication failure or as an exporter error.
+func recordCollectError(credential credentials, err error) {
+	if errors.Is(err, errAuthFailed) {
+		log.WithFields(log.Fields{
+			"username":   credential.Username,
+			"token_type": credential.tokenType(),
+			"reason":     "auth_failed",
+		}).Errorf("Authentication failed, check that the password or token is correct and not expired or revoked: %v", err)
+		authFailuresCount.WithLabelValues(credential.Username, credential.registry()).Inc()
+		return
 	}
-	limit, remaining, limitWindow, remainingWindow, source, err := getLimits(token, timeout)
+	if errors.Is(err, errAnonymousFallback) {
+		log.WithFields(log.Fields{
+			"username":   credential.Username,
+			"token_type": credential.tokenType(),
+			"reason":     "anonymous_fallback",
+		}).Warnf("Credential was treated as anonymous, check that the token has not lost its scope and the account is not locked: %v", err)
+		anonymousFallbackCount.WithLabelValues(credential.Username, credential.registry()).Inc()
+		return
+	}
+	log.WithFields(log.Fields{
+		"username": credential.Username,
+	}).Error(err)
+	errorsCount.WithLabelValues(credential.Username, credential.registry()).Inc()
+}
+
+// handleShutdown waits for a termination signal and runs the hooks in order
+// before exiting.
+func handleShutdown(hooks ...func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	log.Info("Shutting down")
+	for _, hook := range hooks {
+		hook()
+	}
+	os.Exit(0)
+}
+
+type limits struct {
+	limit           int
+	remaining       int
+	limitWindow     int
+	remainingWindow int
+	source          string
+	registry        string
+	// reset is the number of seconds until the quota resets, when the registry
+	// reports it.
+	reset int
+	// policy is the name of the IETF RateLimit policy the limits belong to.
+	policy string
+	// windows holds every policy the registry reported, the headline limits
+	// above being the most restrictive of them.
+	windows []windowLimits
+	// tokenExpiry is when the token used for the probe expires, if known.
+	tokenExpiry time.Time
+	// userID is the user the registry token was issued for, if known.
+	userID string
+	// unlimited is set when the registry reported no rate limit at all, in
+	// which case the other fields are meaningless.
+	unlimited bool
+}
+
+func collectMetrics(credential credentials, timeout time.Duration, anonymousAlias string) (limits, error) {
+	l, err := probeCredential(credential, timeout)
 	if err != nil {
-		return err
+		return limits{}, err
 	}
 
-	username := credential.Username
-	if credential.Anonymous {
-		if anonymousAlias != "" {
-			username = anonymousAlias
-		} else {
-			username = source
-		}
+	recordLimits(accountName(credential, anonymousAlias, l.source), l, time.Now())
+	return l, nil
+}
+
+// recordLimits stores the limits of an account read at now and updates its
+// metrics.
+func recordLimits(username string, l limits, now time.Time) {
+	state.record(username, l, now)
+	setLimitMetrics(username, l, now)
+	if !l.unlimited {
+		setConsumptionMetrics(username, l, consumption.observe(accountKey(l.registry, username), l, now))
+	}
+}
+
+// probeCredential probes the limits of a credential with the driver of its registry.
+func probeCredential(credential credentials, timeout time.Duration) (limits, error) {
+	driver, err := registryDriverFor(credential.registry())
+	if err != nil {
+		return limits{}, err
 	}
-	pullLimit.WithLabelValues(username, source).Set(float64(limit))
-	pullRemaining.WithLabelValues(username, source).Set(float64(remaining))
-	limitWindowSeconds.WithLabelValues(username, source).Set(float64(limitWindow))
-	remainingWindowSeconds.WithLabelValues(username, source).Set(float64(remainingWindow))
+	l, err := driver.probe(credential, timeout)
+	if err != nil {
+		return limits{}, err
+	}
+	l.registry = credential.registry()
+	if err := checkSource(credential, l.source); err != nil {
+		return limits{}, err
+	}
+	return l, nil
+}
+
+// errAnonymousFallback marks collections of a named credential that were
+// answered with the anonymous limits of the exporter's IP address, which
+// happens when the registry hands out an anonymous token for a credential that
+// lost its scope or belongs to a locked account.
+var errAnonymousFallback = errors.New("registry fell back to anonymous limits")
+
+// checkSource checks that the source the registry reports the limits for
+// matches the credential: a user ID for named credentials and an IP address
+// for anonymous ones.
+func checkSource(credential credentials, source string) error {
+	if credential.Anonymous || net.ParseIP(source) == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: limits reported for source %s", errAnonymousFallback, source)
+}
+
+// accountName returns the account label for a credential. Anonymous credentials
+// are reported under the alias when one is configured, or the source IP otherwise.
+func accountName(credential credentials, anonymousAlias string, source string) string {
+	if !credential.Anonymous {
+		return credential.Username
+	}
+	if anonymousAlias != "" {
+		return anonymousAlias
+	}
+	if source == "" {
+		return "anonymous"
+	}
+	return source
+}
 
-	return nil
+// accountKey identifies an account across registries, since the same username
+// can exist in several of them.
+func accountKey(registry string, account string) string {
+	return registry + "/" + account
 }
 
 func configureLogs(logLevel string) error {
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -12,44 +15,263 @@ import (
 
 const prefix = "dockerhub_pull_"
 
+var accountLabels = []string{"account", "source", "registry", "policy"}
+
+// windowLabels identify each of the policies an account is subject to.
+var windowLabels = []string{"account", "source", "registry", "policy", "window"}
+
 var (
-	pullLimit = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%slimit_total", prefix),
-			Help: "The rate limit for DockerHub pulls",
+	pullLimitOpts = prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%slimit_total", prefix),
+		Help: "The rate limit for DockerHub pulls",
+	}
+	pullRemainingOpts = prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%sremaining_total", prefix),
+		Help: "The remaining DockerHub pulls",
+	}
+	limitWindowSecondsOpts = prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%slimit_window_seconds", prefix),
+		Help: "The time window in seconds to which the limit applies",
+	}
+	remainingWindowSecondsOpts = prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%sremaining_window_seconds", prefix),
+		Help: "The time window in seconds to which the remaining pulls apply",
+	}
+	lastSuccessTimestampOpts = prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%slast_success_timestamp_seconds", prefix),
+		Help: "The unix time at which the DockerHub limits were last collected successfully",
+	}
+	consumptionPerHourOpts = prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%sconsumption_per_hour", prefix),
+		Help: "The estimated DockerHub pulls consumed per hour within the current window",
+	}
+	estimatedExhaustionSecondsOpts = prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%sestimated_exhaustion_seconds", prefix),
+		Help: "The estimated time in seconds until no DockerHub pulls remain at the current consumption rate",
+	}
+	estimatedResetTimestampOpts = prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%sestimated_reset_timestamp_seconds", prefix),
+		Help: "The estimated unix time at which the remaining DockerHub pulls reset",
+	}
+	windowLimitOpts = prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%swindow_limit_total", prefix),
+		Help: "The rate limit for DockerHub pulls of every policy, by window in seconds",
+	}
+	windowRemainingOpts = prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%swindow_remaining_total", prefix),
+		Help: "The remaining DockerHub pulls of every policy, by window in seconds",
+	}
+)
+
+var (
+	pullLimit                  = promauto.NewGaugeVec(pullLimitOpts, accountLabels)
+	pullRemaining              = promauto.NewGaugeVec(pullRemainingOpts, accountLabels)
+	limitWindowSeconds         = promauto.NewGaugeVec(limitWindowSecondsOpts, accountLabels)
+	remainingWindowSeconds     = promauto.NewGaugeVec(remainingWindowSecondsOpts, accountLabels)
+	lastSuccessTimestamp       = promauto.NewGaugeVec(lastSuccessTimestampOpts, accountLabels)
+	consumptionPerHour         = promauto.NewGaugeVec(consumptionPerHourOpts, accountLabels)
+	estimatedExhaustionSeconds = promauto.NewGaugeVec(estimatedExhaustionSecondsOpts, accountLabels)
+	estimatedResetTimestamp    = promauto.NewGaugeVec(estimatedResetTimestampOpts, accountLabels)
+	windowLimit                = promauto.NewGaugeVec(windowLimitOpts, windowLabels)
+	windowRemaining            = promauto.NewGaugeVec(windowRemainingOpts, windowLabels)
+	errorsCount                = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: fmt.Sprintf("%serrors_total", prefix),
+			Help: "Exporter errors",
 		},
-		[]string{"account", "source"},
+		[]string{"account", "registry"},
 	)
-	pullRemaining = promauto.NewGaugeVec(
+	authFailuresCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: fmt.Sprintf("%sauth_failures_total", prefix),
+			Help: "Collections that failed because the credential was rejected",
+		},
+		[]string{"account", "registry"},
+	)
+	anonymousFallbackCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: fmt.Sprintf("%sanonymous_fallbacks_total", prefix),
+			Help: "Collections of a named credential that were answered with anonymous limits",
+		},
+		[]string{"account", "registry"},
+	)
+	unlimitedAccount = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%sremaining_total", prefix),
-			Help: "The remaining DockerHub pulls",
+			Name: fmt.Sprintf("%sunlimited", prefix),
+			Help: "Whether the account has no pull rate limit",
 		},
-		[]string{"account", "source"},
+		[]string{"account", "registry"},
 	)
-	limitWindowSeconds = promauto.NewGaugeVec(
+	accountInfo = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%slimit_window_seconds", prefix),
-			Help: "The time window in seconds to which the limit applies",
+			Name: fmt.Sprintf("%saccount_info", prefix),
+			Help: "The user ID the registry token of the account was issued for",
 		},
-		[]string{"account", "source"},
+		[]string{"account", "registry", "user_id"},
 	)
-	remainingWindowSeconds = promauto.NewGaugeVec(
+	tokenExpiryTimestamp = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%sremaining_window_seconds", prefix),
-			Help: "The time window in seconds to which the remaining pulls apply",
+			Name: fmt.Sprintf("%stoken_expiry_timestamp_seconds", prefix),
+			Help: "The unix time at which the registry token used for the last collection expires",
+		},
+		[]string{"account", "registry"},
+	)
+)
+
+var imagePulls = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: fmt.Sprintf("%simage_pulls_total", prefix),
+		Help: "Image pulls seen in the events of the container runtime",
+	},
+	[]string{"image", "registry", "containerd_namespace", "namespace", "node"},
+)
+
+var proxyPulls = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: fmt.Sprintf("%sproxy_pulls_total", prefix),
+		Help: "Pulls forwarded by the pull proxy",
+	},
+	[]string{"client", "repository"},
+)
+
+var leasesCount = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: fmt.Sprintf("%sleases_total", prefix),
+		Help: "Credentials leased by the credential broker",
+	},
+	[]string{"pool", "account"},
+)
+
+var cacheMisses = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: fmt.Sprintf("%scache_misses_total", prefix),
+		Help: "Manifests the pull-through cache fetched from Docker Hub",
+	},
+	[]string{"repository"},
+)
+
+var throttledEvents = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: fmt.Sprintf("%sthrottled_events_total", prefix),
+		Help: "Image pulls Kubernetes reported as failed because of the Docker Hub rate limit",
+	},
+	[]string{"namespace", "image", "node"},
+)
+
+var (
+	schedulerLag = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    fmt.Sprintf("%sscheduler_lag_seconds", prefix),
+			Help:    "The time in seconds probes waited for a worker after being scheduled",
+			Buckets: []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 120},
 		},
-		[]string{"account", "source"},
 	)
-	errorsCount = promauto.NewCounterVec(
+	schedulerSkipped = promauto.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: fmt.Sprintf("%serrors_total", prefix),
-			Help: "Exporter errors",
+			Name: fmt.Sprintf("%sscheduler_skipped_total", prefix),
+			Help: "Probes skipped because the previous probe of the account was still running",
+		},
+		[]string{"account", "registry"},
+	)
+	pollIntervalSeconds = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: fmt.Sprintf("%spoll_interval_seconds", prefix),
+			Help: "The current interval in seconds between probes of the account",
+		},
+		[]string{"account", "registry"},
+	)
+	schedulerRunning = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: fmt.Sprintf("%sscheduler_running_probes", prefix),
+			Help: "The number of probes currently running",
 		},
-		[]string{"account"},
 	)
 )
 
+// limitGauges are the gauges updated by the background collectors.
+var limitGauges = []prometheus.Collector{
+	pullLimit,
+	pullRemaining,
+	limitWindowSeconds,
+	remainingWindowSeconds,
+	lastSuccessTimestamp,
+	consumptionPerHour,
+	estimatedExhaustionSeconds,
+	estimatedResetTimestamp,
+	windowLimit,
+	windowRemaining,
+	unlimitedAccount,
+}
+
+// accountGauges are the limit gauges that only make sense for accounts with a
+// rate limit.
+var accountGauges = []*prometheus.GaugeVec{
+	pullLimit,
+	pullRemaining,
+	limitWindowSeconds,
+	remainingWindowSeconds,
+	lastSuccessTimestamp,
+	consumptionPerHour,
+	estimatedExhaustionSeconds,
+	estimatedResetTimestamp,
+	windowLimit,
+	windowRemaining,
+}
+
+func setLimitMetrics(username string, l limits, collectedAt time.Time) {
+	if !l.tokenExpiry.IsZero() {
+		tokenExpiryTimestamp.WithLabelValues(username, l.registry).Set(timestampSeconds(l.tokenExpiry))
+	}
+	if l.userID != "" {
+		accountInfo.DeletePartialMatch(prometheus.Labels{"account": username, "registry": l.registry})
+		accountInfo.WithLabelValues(username, l.registry, l.userID).Set(1)
+	}
+	if l.unlimited {
+		unlimitedAccount.WithLabelValues(username, l.registry).Set(1)
+		for _, gauge := range accountGauges {
+			gauge.DeletePartialMatch(prometheus.Labels{"account": username, "registry": l.registry})
+		}
+		return
+	}
+	unlimitedAccount.WithLabelValues(username, l.registry).Set(0)
+	pullLimit.WithLabelValues(username, l.source, l.registry, l.policy).Set(float64(l.limit))
+	pullRemaining.WithLabelValues(username, l.source, l.registry, l.policy).Set(float64(l.remaining))
+	limitWindowSeconds.WithLabelValues(username, l.source, l.registry, l.policy).Set(float64(l.limitWindow))
+	remainingWindowSeconds.WithLabelValues(username, l.source, l.registry, l.policy).Set(float64(l.remainingWindow))
+	lastSuccessTimestamp.WithLabelValues(username, l.source, l.registry, l.policy).Set(timestampSeconds(collectedAt))
+	for _, w := range l.windows {
+		window := strconv.Itoa(w.window)
+		windowLimit.WithLabelValues(username, l.source, l.registry, w.policy, window).Set(float64(w.limit))
+		windowRemaining.WithLabelValues(username, l.source, l.registry, w.policy, window).Set(float64(w.remaining))
+	}
+}
+
+func timestampSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func setConsumptionMetrics(username string, l limits, estimate consumptionEstimate) {
+	consumptionPerHour.WithLabelValues(username, l.source, l.registry, l.policy).Set(estimate.pullsPerHour)
+	estimatedResetTimestamp.WithLabelValues(username, l.source, l.registry, l.policy).Set(estimate.resetTimestamp)
+	if estimate.exhausting {
+		estimatedExhaustionSeconds.WithLabelValues(username, l.source, l.registry, l.policy).Set(estimate.exhaustionSeconds)
+	} else {
+		estimatedExhaustionSeconds.DeleteLabelValues(username, l.source, l.registry, l.policy)
+	}
+}
+
+// registerLimitsCollector replaces the limit gauges updated by the background
+// collectors with a collector that probes Docker Hub on every scrape. The
+// readings restored from the state file are handed over to the collector.
+func registerLimitsCollector(config configuration) {
+	for _, gauge := range limitGauges {
+		prometheus.Unregister(gauge)
+	}
+	collector := newLimitsCollector(config)
+	collector.restore(state.snapshot())
+	prometheus.MustRegister(collector)
+}
+
 func healthcheckHandler(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	_, err := fmt.Fprintf(w, "OK")
@@ -58,10 +280,35 @@ func healthcheckHandler(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
-func startMetricsServer(port int) error {
+// readyHandler reports whether the replica can serve metrics.
+func readyHandler(ready func() bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if !ready() {
+			http.Error(w, "Not ready", http.StatusServiceUnavailable)
+			return
+		}
+		healthcheckHandler(w, nil)
+	}
+}
+
+// stateHandler serves the last known readings of every account as JSON.
+func stateHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(state.snapshot()); err != nil {
+		log.Errorf("error responding to request %v", err)
+	}
+}
+
+func startMetricsServer(port int, config configuration, ready func() bool) error {
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
+	if !config.OTLP.ReplacePrometheus {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+	mux.HandleFunc("/probe", probeHandler(config))
 	mux.HandleFunc("/health", healthcheckHandler)
+	mux.HandleFunc("/ready", readyHandler(ready))
+	mux.HandleFunc("/api/v1/state", stateHandler)
+	mux.HandleFunc("/api/v1/pools", poolsHandler(config))
 	log.Printf("Starting metrics server on port %d", port)
 	return http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
 }
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	grpccredentials "google.golang.org/grpc/credentials"
+)
+
+type otlpConfig struct {
+	Endpoint string            `yaml:"endpoint"`
+	Protocol string            `yaml:"protocol"`
+	URLPath  string            `yaml:"url_path"`
+	Insecure bool              `yaml:"insecure"`
+	Headers  map[string]string `yaml:"headers"`
+	TLS      tlsConfig         `yaml:"tls"`
+	Interval time.Duration     `yaml:"interval"`
+	Instance string            `yaml:"instance"`
+	// ReplacePrometheus stops serving /metrics when OTLP export is enabled.
+	ReplacePrometheus bool `yaml:"replace_prometheus"`
+}
+
+// otlpExporter sends the last known readings of every account as OTLP metrics.
+// A nil otlpExporter does nothing.
+type otlpExporter struct {
+	provider *sdkmetric.MeterProvider
+}
+
+func newOTLPExporter(config configuration) (*otlpExporter, error) {
+	if config.OTLP.Endpoint == "" {
+		return nil, nil
+	}
+	ctx := context.Background()
+
+	exporter, err := newOTLPMetricExporter(ctx, config.OTLP)
+	if err != nil {
+		return nil, err
+	}
+
+	instance := config.OTLP.Instance
+	if instance == "" {
+		instance, err = os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+	}
+	res := resource.NewSchemaless(
+		attribute.String("service.name", "dockerhub-pull-limit-exporter"),
+		attribute.String("service.version", Version),
+		attribute.String("service.instance.id", instance),
+	)
+
+	interval := config.OTLP.Interval
+	if interval == 0 {
+		interval = config.UpdateInterval
+	}
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(accountResourceExporter{exporter}, sdkmetric.WithInterval(interval))),
+	)
+	if err := registerOTLPInstruments(provider.Meter("dockerhub-pull-limit-exporter")); err != nil {
+		return nil, err
+	}
+	return &otlpExporter{provider: provider}, nil
+}
+
+func newOTLPMetricExporter(ctx context.Context, config otlpConfig) (sdkmetric.Exporter, error) {
+	tlsSettings, err := config.TLS.build()
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Protocol {
+	case "", "grpc":
+		options := []otlpmetricgrpc.Option{
+			otlpmetricgrpc.WithEndpoint(config.Endpoint),
+			otlpmetricgrpc.WithHeaders(config.Headers),
+		}
+		if config.Insecure {
+			options = append(options, otlpmetricgrpc.WithInsecure())
+		} else {
+			options = append(options, otlpmetricgrpc.WithTLSCredentials(grpccredentials.NewTLS(tlsSettings)))
+		}
+		return otlpmetricgrpc.New(ctx, options...)
+	case "http":
+		options := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(config.Endpoint),
+			otlpmetrichttp.WithHeaders(config.Headers),
+		}
+		if config.URLPath != "" {
+			options = append(options, otlpmetrichttp.WithURLPath(config.URLPath))
+		}
+		if config.Insecure {
+			options = append(options, otlpmetrichttp.WithInsecure())
+		} else {
+			options = append(options, otlpmetrichttp.WithTLSClientConfig(tlsSettings))
+		}
+		return otlpmetrichttp.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q", config.Protocol)
+	}
+}
+
+// registerOTLPInstruments registers observable instruments that report the
+// readings kept in the state store and the exporter errors.
+func registerOTLPInstruments(meter metric.Meter) error {
+	limitGauge, err := meter.Int64ObservableGauge("dockerhub.pull.limit",
+		metric.WithDescription("The rate limit for DockerHub pulls"), metric.WithUnit("{pull}"))
+	if err != nil {
+		return err
+	}
+	remainingGauge, err := meter.Int64ObservableGauge("dockerhub.pull.remaining",
+		metric.WithDescription("The remaining DockerHub pulls"), metric.WithUnit("{pull}"))
+	if err != nil {
+		return err
+	}
+	limitWindowGauge, err := meter.Int64ObservableGauge("dockerhub.pull.limit_window",
+		metric.WithDescription("The time window to which the limit applies"), metric.WithUnit("s"))
+	if err != nil {
+		return err
+	}
+	remainingWindowGauge, err := meter.Int64ObservableGauge("dockerhub.pull.remaining_window",
+		metric.WithDescription("The time window to which the remaining pulls apply"), metric.WithUnit("s"))
+	if err != nil {
+		return err
+	}
+	errorsCounter, err := meter.Float64ObservableCounter("dockerhub.pull.errors",
+		metric.WithDescription("Exporter errors"), metric.WithUnit("{error}"))
+	if err != nil {
+		return err
+	}
+	authFailuresCounter, err := meter.Float64ObservableCounter("dockerhub.pull.auth_failures",
+		metric.WithDescription("Collections that failed because the credential was rejected"), metric.WithUnit("{error}"))
+	if err != nil {
+		return err
+	}
+	anonymousFallbacksCounter, err := meter.Float64ObservableCounter("dockerhub.pull.anonymous_fallbacks",
+		metric.WithDescription("Collections of a named credential that were answered with anonymous limits"), metric.WithUnit("{error}"))
+	if err != nil {
+		return err
+	}
+	counters := map[metric.Float64Observable]*prometheus.CounterVec{
+		errorsCounter:             errorsCount,
+		authFailuresCounter:       authFailuresCount,
+		anonymousFallbacksCounter: anonymousFallbackCount,
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, observer metric.Observer) error {
+		for _, account := range state.snapshot() {
+			if account.Unlimited {
+				continue
+			}
+			attributes := metric.WithAttributes(
+				attribute.String("account", account.Account),
+				attribute.String("source", account.Source),
+				attribute.String("registry", account.registry()),
+				attribute.String("policy", account.Policy),
+			)
+			observer.ObserveInt64(limitGauge, int64(account.Limit), attributes)
+			observer.ObserveInt64(remainingGauge, int64(account.Remaining), attributes)
+			observer.ObserveInt64(limitWindowGauge, int64(account.LimitWindow), attributes)
+			observer.ObserveInt64(remainingWindowGauge, int64(account.RemainingWindow), attributes)
+		}
+		for instrument, vec := range counters {
+			for _, counter := range counterValues(vec) {
+				var attributes []attribute.KeyValue
+				for name, value := range counter.labels {
+					attributes = append(attributes, attribute.String(name, value))
+				}
+				observer.ObserveFloat64(instrument, counter.value, metric.WithAttributes(attributes...))
+			}
+		}
+		return nil
+	}, limitGauge, remainingGauge, limitWindowGauge, remainingWindowGauge, errorsCounter, authFailuresCounter, anonymousFallbacksCounter)
+	return err
+}
+
+// accountResourceExporter exports the data points of every account with the
+// account as a resource attribute. The instruments share a single meter
+// provider, so they are observed with an account attribute that is moved to
+// the resource before exporting.
+type accountResourceExporter struct {
+	sdkmetric.Exporter
+}
+
+func (e accountResourceExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	var errs []error
+	for _, accountMetrics := range splitByAccount(rm) {
+		if err := e.Exporter.Export(ctx, accountMetrics); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// splitByAccount splits the metrics into one resource per value of the account
+// attribute of their data points. Data points without it keep the original
+// resource.
+func splitByAccount(rm *metricdata.ResourceMetrics) []*metricdata.ResourceMetrics {
+	byAccount := map[string]*metricdata.ResourceMetrics{}
+	var accounts []string
+	resourceFor := func(account string) *metricdata.ResourceMetrics {
+		if accountMetrics, ok := byAccount[account]; ok {
+			return accountMetrics
+		}
+		res := rm.Resource
+		if account != "" {
+			// Both resources are schemaless, so merging them can't fail.
+			res, _ = resource.Merge(rm.Resource, resource.NewSchemaless(attribute.String("account", account)))
+		}
+		accountMetrics := &metricdata.ResourceMetrics{Resource: res}
+		byAccount[account] = accountMetrics
+		accounts = append(accounts, account)
+		return accountMetrics
+	}
+
+	for _, scopeMetrics := range rm.ScopeMetrics {
+		for _, m := range scopeMetrics.Metrics {
+			for account, data := range splitAggregation(m.Data) {
+				accountMetrics := resourceFor(account)
+				i := slices.IndexFunc(accountMetrics.ScopeMetrics, func(s metricdata.ScopeMetrics) bool {
+					return s.Scope == scopeMetrics.Scope
+				})
+				if i < 0 {
+					accountMetrics.ScopeMetrics = append(accountMetrics.ScopeMetrics, metricdata.ScopeMetrics{Scope: scopeMetrics.Scope})
+					i = len(accountMetrics.ScopeMetrics) - 1
+				}
+				split := m
+				split.Data = data
+				accountMetrics.ScopeMetrics[i].Metrics = append(accountMetrics.ScopeMetrics[i].Metrics, split)
+			}
+		}
+	}
+
+	slices.Sort(accounts)
+	result := make([]*metricdata.ResourceMetrics, 0, len(accounts))
+	for _, account := range accounts {
+		result = append(result, byAccount[account])
+	}
+	return result
+}
+
+// splitAggregation splits the data points of the gauges and sums the exporter
+// registers by their account attribute.
+func splitAggregation(data metricdata.Aggregation) map[string]metricdata.Aggregation {
+	split := map[string]metricdata.Aggregation{}
+	switch data := data.(type) {
+	case metricdata.Gauge[int64]:
+		for account, points := range splitDataPoints(data.DataPoints) {
+			split[account] = metricdata.Gauge[int64]{DataPoints: points}
+		}
+	case metricdata.Sum[float64]:
+		for account, points := range splitDataPoints(data.DataPoints) {
+			split[account] = metricdata.Sum[float64]{DataPoints: points, Temporality: data.Temporality, IsMonotonic: data.IsMonotonic}
+		}
+	default:
+		split[""] = data
+	}
+	return split
+}
+
+func splitDataPoints[N int64 | float64](points []metricdata.DataPoint[N]) map[string][]metricdata.DataPoint[N] {
+	split := map[string][]metricdata.DataPoint[N]{}
+	for _, point := range points {
+		account, _ := point.Attributes.Value("account")
+		point.Attributes, _ = point.Attributes.Filter(func(kv attribute.KeyValue) bool {
+			return kv.Key != "account"
+		})
+		split[account.AsString()] = append(split[account.AsString()], point)
+	}
+	return split
+}
+
+type counterValue struct {
+	labels map[string]string
+	value  float64
+}
+
+// counterValues returns the current value of every child of a counter vector
+// together with its labels.
+func counterValues(counter *prometheus.CounterVec) []counterValue {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		counter.Collect(metrics)
+		close(metrics)
+	}()
+
+	var values []counterValue
+	for m := range metrics {
+		var written dto.Metric
+		if err := m.Write(&written); err != nil {
+			log.Errorf("Failed to read counter: %v", err)
+			continue
+		}
+		labels := map[string]string{}
+		for _, pair := range written.GetLabel() {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		values = append(values, counterValue{labels: labels, value: written.GetCounter().GetValue()})
+	}
+	return values
+}
+
+func (e *otlpExporter) shutdown() {
+	if e == nil {
+		return
+	}
+	if err := e.provider.Shutdown(context.Background()); err != nil {
+		log.Errorf("Failed to shut down the OTLP exporter: %v", err)
+	}
+}
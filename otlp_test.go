@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var mutex sync.Mutex
+	var received []*colmetricpb.ExportMetricsServiceRequest
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		request := &colmetricpb.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mutex.Lock()
+		received = append(received, request)
+		mutex.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	exportToReceiver(t, otlpConfig{
+		Endpoint: strings.TrimPrefix(receiver.URL, "http://"),
+		Protocol: "http",
+		Insecure: true,
+		Instance: "server001",
+	}, "otlp-user")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	checkExportedAccount(t, received, "otlp-user")
+}
+
+type fakeOTLPReceiver struct {
+	colmetricpb.UnimplementedMetricsServiceServer
+	mutex    sync.Mutex
+	received []*colmetricpb.ExportMetricsServiceRequest
+}
+
+func (f *fakeOTLPReceiver) Export(_ context.Context, request *colmetricpb.ExportMetricsServiceRequest) (*colmetricpb.ExportMetricsServiceResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.received = append(f.received, request)
+	return &colmetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+func TestOTLPExporterGRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	receiver := &fakeOTLPReceiver{}
+	server := grpc.NewServer()
+	colmetricpb.RegisterMetricsServiceServer(server, receiver)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+
+	exportToReceiver(t, otlpConfig{
+		Endpoint: listener.Addr().String(),
+		Protocol: "grpc",
+		Insecure: true,
+		Instance: "server001",
+	}, "otlp-grpc-user")
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	checkExportedAccount(t, receiver.received, "otlp-grpc-user")
+}
+
+// exportToReceiver records a reading and an error for the account and exports
+// them once.
+func exportToReceiver(t *testing.T, config otlpConfig, account string) {
+	t.Helper()
+	state.record(account, limits{limit: 100, remaining: 42, limitWindow: 21600, remainingWindow: 21600, source: "192.0.2.1"}, time.Now())
+	errorsCount.WithLabelValues(account, "dockerhub").Inc()
+	authFailuresCount.WithLabelValues(account, "dockerhub").Inc()
+	anonymousFallbackCount.WithLabelValues(account, "dockerhub").Inc()
+
+	exporter, err := newOTLPExporter(configuration{UpdateInterval: time.Hour, OTLP: config})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := exporter.provider.ForceFlush(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	exporter.shutdown()
+}
+
+// checkExportedAccount checks that the metrics of the account were exported as
+// a resource of their own.
+func checkExportedAccount(t *testing.T, received []*colmetricpb.ExportMetricsServiceRequest, account string) {
+	t.Helper()
+	var resourceMetrics *metricpb.ResourceMetrics
+	for _, request := range received {
+		for _, candidate := range request.GetResourceMetrics() {
+			if resourceAttribute(candidate, "account") == account {
+				resourceMetrics = candidate
+			}
+		}
+	}
+	if resourceMetrics == nil {
+		t.Fatalf("expected a resource for account %s", account)
+	}
+	if got := resourceAttribute(resourceMetrics, "service.instance.id"); got != "server001" {
+		t.Errorf("expected instance server001, got %q", got)
+	}
+
+	metrics := map[string]*metricpb.Metric{}
+	for _, scopeMetrics := range resourceMetrics.GetScopeMetrics() {
+		for _, m := range scopeMetrics.GetMetrics() {
+			metrics[m.GetName()] = m
+		}
+	}
+	for _, name := range []string{"dockerhub.pull.limit", "dockerhub.pull.remaining", "dockerhub.pull.limit_window", "dockerhub.pull.remaining_window", "dockerhub.pull.errors", "dockerhub.pull.auth_failures", "dockerhub.pull.anonymous_fallbacks"} {
+		if _, ok := metrics[name]; !ok {
+			t.Errorf("expected metric %s to be exported", name)
+		}
+	}
+	points := metrics["dockerhub.pull.remaining"].GetGauge().GetDataPoints()
+	if len(points) != 1 {
+		t.Fatalf("expected 1 data point, got %d", len(points))
+	}
+	if points[0].GetAsInt() != 42 {
+		t.Errorf("expected 42 remaining pulls, got %d", points[0].GetAsInt())
+	}
+	for _, attribute := range points[0].GetAttributes() {
+		if attribute.GetKey() == "account" {
+			t.Error("expected the account to be a resource attribute only")
+		}
+	}
+}
+
+func TestOTLPExporterDisabled(t *testing.T) {
+	exporter, err := newOTLPExporter(configuration{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if exporter != nil {
+		t.Fatal("expected no exporter when no endpoint is configured")
+	}
+	exporter.shutdown()
+}
+
+func resourceAttribute(resourceMetrics *metricpb.ResourceMetrics, key string) string {
+	for _, attribute := range resourceMetrics.GetResource().GetAttributes() {
+		if attribute.GetKey() == key {
+			return attribute.GetValue().GetStringValue()
+		}
+	}
+	return ""
+}
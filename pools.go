@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+type poolConfig struct {
+	// Accounts are the accounts of the pool besides the credentials that name
+	// it in their pool, such as the accounts seen by the pull proxy.
+	Accounts []string `yaml:"accounts"`
+	// Registry is the registry of Accounts, Docker Hub when empty.
+	Registry string `yaml:"registry"`
+	// MinRemaining is the remaining pulls below which the pool is degraded.
+	MinRemaining int `yaml:"min_remaining"`
+}
+
+func (p poolConfig) registry() string {
+	if p.Registry == "" {
+		return dockerHubRegistry
+	}
+	return p.Registry
+}
+
+const (
+	poolHealthy   = "healthy"
+	poolDegraded  = "degraded"
+	poolExhausted = "exhausted"
+	poolUnknown   = "unknown"
+)
+
+// poolHealth aggregates the last readings of the accounts of a pool.
+type poolHealth struct {
+	Pool              string `json:"pool"`
+	Status            string `json:"status"`
+	Limit             int    `json:"limit"`
+	Remaining         int    `json:"remaining"`
+	Accounts          int    `json:"accounts"`
+	AccountsReporting int    `json:"accounts_reporting"`
+	AccountsExhausted int    `json:"accounts_exhausted"`
+	AccountsUnlimited int    `json:"accounts_unlimited"`
+}
+
+// configurePools puts the credentials listed in the accounts of a pool in that
+// pool, and declares the pools named by credentials but missing from pools.
+func configurePools(c *configuration) error {
+	for name, pool := range c.Pools {
+		for _, account := range pool.Accounts {
+			for i, credential := range c.Credentials {
+				if credential.Anonymous || credential.Username != account || credential.registry() != pool.registry() {
+					continue
+				}
+				if credential.Pool != "" && credential.Pool != name {
+					return fmt.Errorf("user [%s] can't be part of pools %s and %s", account, credential.Pool, name)
+				}
+				c.Credentials[i].Pool = name
+			}
+		}
+	}
+	for _, credential := range c.Credentials {
+		if credential.Pool == "" {
+			continue
+		}
+		if _, ok := c.Pools[credential.Pool]; !ok {
+			if c.Pools == nil {
+				c.Pools = map[string]poolConfig{}
+			}
+			c.Pools[credential.Pool] = poolConfig{}
+		}
+	}
+	return nil
+}
+
+// poolMembers returns the state keys of the accounts of every pool.
+func poolMembers(config configuration) map[string][]string {
+	members := map[string][]string{}
+	seen := map[string]bool{}
+	add := func(pool, key string) {
+		if !seen[pool+"\x00"+key] {
+			seen[pool+"\x00"+key] = true
+			members[pool] = append(members[pool], key)
+		}
+	}
+	for name, pool := range config.Pools {
+		members[name] = []string{}
+		for _, account := range pool.Accounts {
+			add(name, accountKey(pool.registry(), account))
+		}
+	}
+	for _, credential := range config.Credentials {
+		if credential.Pool != "" {
+			add(credential.Pool, accountKey(credential.registry(), credential.Username))
+		}
+	}
+	return members
+}
+
+// poolsHealth returns the health of every pool sorted by name.
+func poolsHealth(config configuration) []poolHealth {
+	members := poolMembers(config)
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pools := make([]poolHealth, 0, len(names))
+	for _, name := range names {
+		health := poolHealth{Pool: name, Accounts: len(members[name])}
+		for _, key := range members[name] {
+			reading, ok := state.get(key)
+			if !ok {
+				continue
+			}
+			health.AccountsReporting++
+			if reading.Unlimited {
+				health.AccountsUnlimited++
+				continue
+			}
+			health.Limit += reading.Limit
+			health.Remaining += reading.Remaining
+			if reading.Remaining <= 0 {
+				health.AccountsExhausted++
+			}
+		}
+		health.Status = health.status(config.Pools[name].MinRemaining)
+		pools = append(pools, health)
+	}
+	return pools
+}
+
+func (h poolHealth) status(minRemaining int) string {
+	switch {
+	case h.AccountsReporting == 0:
+		return poolUnknown
+	case h.AccountsUnlimited == 0 && h.AccountsExhausted == h.AccountsReporting:
+		return poolExhausted
+	case h.AccountsExhausted > 0 || h.AccountsReporting < h.Accounts:
+		return poolDegraded
+	case h.AccountsUnlimited == 0 && h.Remaining < minRemaining:
+		return poolDegraded
+	}
+	return poolHealthy
+}
+
+func poolsHandler(config configuration) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(poolsHealth(config)); err != nil {
+			log.Errorf("error responding to request %v", err)
+		}
+	}
+}
+
+// poolCollector exports the combined limits of every pool from the last
+// readings of its accounts. Pools without any reading are left out, and
+// unlimited accounts don't add to the limit or the remaining pulls.
+type poolCollector struct {
+	config configuration
+
+	limitDesc     *prometheus.Desc
+	remainingDesc *prometheus.Desc
+	exhaustedDesc *prometheus.Desc
+}
+
+func newPoolCollector(config configuration) *poolCollector {
+	labels := []string{"pool"}
+	return &poolCollector{
+		config: config,
+		limitDesc: prometheus.NewDesc(fmt.Sprintf("%spool_limit", prefix),
+			"The combined rate limit of the accounts of the pool", labels, nil),
+		remainingDesc: prometheus.NewDesc(fmt.Sprintf("%spool_remaining", prefix),
+			"The combined remaining pulls of the accounts of the pool", labels, nil),
+		exhaustedDesc: prometheus.NewDesc(fmt.Sprintf("%spool_accounts_exhausted", prefix),
+			"Accounts of the pool without remaining pulls", labels, nil),
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.limitDesc
+	ch <- c.remainingDesc
+	ch <- c.exhaustedDesc
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, health := range poolsHealth(c.config) {
+		if health.AccountsReporting == 0 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.limitDesc, prometheus.GaugeValue, float64(health.Limit), health.Pool)
+		ch <- prometheus.MustNewConstMetric(c.remainingDesc, prometheus.GaugeValue, float64(health.Remaining), health.Pool)
+		ch <- prometheus.MustNewConstMetric(c.exhaustedDesc, prometheus.GaugeValue, float64(health.AccountsExhausted), health.Pool)
+	}
+}
+
+// registerPoolCollector exports the pool metrics when pools are configured.
+func registerPoolCollector(config configuration) {
+	if len(config.Pools) == 0 {
+		return
+	}
+	prometheus.MustRegister(newPoolCollector(config))
+}
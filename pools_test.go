@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConfigurePools(t *testing.T) {
+	c := configuration{
+		Credentials: []credentials{
+			{Username: "runner-1", Password: "pass"},
+			{Username: "runner-2", Password: "pass", Pool: "ci-runners"},
+			{Username: "node-1", Password: "pass", Pool: "prod-nodes"},
+		},
+		Pools: map[string]poolConfig{
+			"ci-runners": {Accounts: []string{"runner-1", "proxy-anonymous"}},
+		},
+	}
+	if err := configurePools(&c); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if c.Credentials[0].Pool != "ci-runners" {
+		t.Errorf("expected runner-1 to be in ci-runners, got %q", c.Credentials[0].Pool)
+	}
+	if _, ok := c.Pools["prod-nodes"]; !ok {
+		t.Error("expected prod-nodes to be declared")
+	}
+	members := poolMembers(c)
+	want := []string{"dockerhub/runner-1", "dockerhub/proxy-anonymous", "dockerhub/runner-2"}
+	if strings.Join(members["ci-runners"], ",") != strings.Join(want, ",") {
+		t.Errorf("expected members %v, got %v", want, members["ci-runners"])
+	}
+
+	c.Pools["prod-nodes"] = poolConfig{Accounts: []string{"runner-2"}}
+	if err := configurePools(&c); err == nil {
+		t.Fatal("expected error for a credential in two pools, got nil")
+	}
+}
+
+func TestPoolsHealth(t *testing.T) {
+	now := time.Now()
+	state.record("pool-healthy-1", limits{limit: 200, remaining: 150, registry: dockerHubRegistry}, now)
+	state.record("pool-healthy-2", limits{limit: 200, remaining: 100, registry: dockerHubRegistry}, now)
+	state.record("pool-low", limits{limit: 200, remaining: 20, registry: dockerHubRegistry}, now)
+	state.record("pool-exhausted-1", limits{limit: 200, remaining: 0, registry: dockerHubRegistry}, now)
+	state.record("pool-exhausted-2", limits{limit: 100, remaining: 0, registry: dockerHubRegistry}, now)
+	state.record("pool-unlimited", limits{unlimited: true, registry: dockerHubRegistry}, now)
+
+	config := configuration{Pools: map[string]poolConfig{
+		"healthy":   {Accounts: []string{"pool-healthy-1", "pool-healthy-2"}, MinRemaining: 100},
+		"low":       {Accounts: []string{"pool-low"}, MinRemaining: 100},
+		"partial":   {Accounts: []string{"pool-healthy-1", "pool-exhausted-1"}},
+		"exhausted": {Accounts: []string{"pool-exhausted-1", "pool-exhausted-2"}},
+		"unlimited": {Accounts: []string{"pool-unlimited", "pool-exhausted-1"}},
+		"missing":   {Accounts: []string{"pool-healthy-1", "pool-never-collected"}},
+		"empty":     {Accounts: []string{"pool-never-collected"}},
+	}}
+
+	tests := []struct {
+		pool      string
+		status    string
+		limit     int
+		remaining int
+		exhausted int
+	}{
+		{"empty", poolUnknown, 0, 0, 0},
+		{"exhausted", poolExhausted, 300, 0, 2},
+		{"healthy", poolHealthy, 400, 250, 0},
+		{"low", poolDegraded, 200, 20, 0},
+		{"missing", poolDegraded, 200, 150, 0},
+		{"partial", poolDegraded, 400, 150, 1},
+		{"unlimited", poolDegraded, 200, 0, 1},
+	}
+	pools := poolsHealth(config)
+	if len(pools) != len(tests) {
+		t.Fatalf("expected %d pools, got %d", len(tests), len(pools))
+	}
+	for i, tt := range tests {
+		t.Run(tt.pool, func(t *testing.T) {
+			got := pools[i]
+			if got.Pool != tt.pool || got.Status != tt.status || got.Limit != tt.limit ||
+				got.Remaining != tt.remaining || got.AccountsExhausted != tt.exhausted {
+				t.Errorf("expected %s to be %s with %d/%d and %d exhausted, got %+v",
+					tt.pool, tt.status, tt.remaining, tt.limit, tt.exhausted, got)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	poolsHandler(config)(rec, httptest.NewRequest(http.MethodGet, "/api/v1/pools", nil))
+	var served []poolHealth
+	if err := json.NewDecoder(rec.Body).Decode(&served); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(served) != len(tests) || served[2].Status != poolHealthy {
+		t.Errorf("expected the pools to be served, got %+v", served)
+	}
+}
+
+func TestPoolCollector(t *testing.T) {
+	now := time.Now()
+	state.record("collector-1", limits{limit: 200, remaining: 120, registry: dockerHubRegistry}, now)
+	state.record("collector-2", limits{limit: 200, remaining: 0, registry: dockerHubRegistry}, now)
+	collector := newPoolCollector(configuration{Pools: map[string]poolConfig{
+		"ci-runners": {Accounts: []string{"collector-1", "collector-2"}},
+		"empty":      {Accounts: []string{"collector-never-collected"}},
+	}})
+
+	expected := `
+# HELP dockerhub_pull_pool_accounts_exhausted Accounts of the pool without remaining pulls
+# TYPE dockerhub_pull_pool_accounts_exhausted gauge
+dockerhub_pull_pool_accounts_exhausted{pool="ci-runners"} 1
+# HELP dockerhub_pull_pool_limit The combined rate limit of the accounts of the pool
+# TYPE dockerhub_pull_pool_limit gauge
+dockerhub_pull_pool_limit{pool="ci-runners"} 400
+# HELP dockerhub_pull_pool_remaining The combined remaining pulls of the accounts of the pool
+# TYPE dockerhub_pull_pool_remaining gauge
+dockerhub_pull_pool_remaining{pool="ci-runners"} 120
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
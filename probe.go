@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// probeHandler serves /probe in the style of blackbox_exporter. The target is
+// selected with either ?account=<username> or ?module=<name> and is probed
+// synchronously, returning only its metrics.
+func probeHandler(config configuration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		credential, alias, err := probeTarget(config, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		registry := prometheus.NewRegistry()
+		probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_success",
+			Help: "Whether the probe succeeded",
+		})
+		probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_duration_seconds",
+			Help: "How long the probe took to complete in seconds",
+		})
+		probeLimit := prometheus.NewGaugeVec(pullLimitOpts, accountLabels)
+		probeRemaining := prometheus.NewGaugeVec(pullRemainingOpts, accountLabels)
+		probeLimitWindow := prometheus.NewGaugeVec(limitWindowSecondsOpts, accountLabels)
+		probeRemainingWindow := prometheus.NewGaugeVec(remainingWindowSecondsOpts, accountLabels)
+		probeWindowLimit := prometheus.NewGaugeVec(windowLimitOpts, windowLabels)
+		probeWindowRemaining := prometheus.NewGaugeVec(windowRemainingOpts, windowLabels)
+		probeUnlimited := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: fmt.Sprintf("%sunlimited", prefix),
+			Help: "Whether the account has no pull rate limit",
+		}, []string{"account", "registry"})
+		registry.MustRegister(probeSuccess, probeDuration, probeLimit, probeRemaining, probeLimitWindow, probeRemainingWindow, probeWindowLimit, probeWindowRemaining, probeUnlimited)
+
+		start := time.Now()
+		l, err := probeCredential(credential, config.Timeout)
+		probeDuration.Set(time.Since(start).Seconds())
+		if err != nil {
+			recordCollectError(credential, err)
+		} else if l.unlimited {
+			probeUnlimited.WithLabelValues(accountName(credential, alias, l.source), l.registry).Set(1)
+			probeSuccess.Set(1)
+		} else {
+			username := accountName(credential, alias, l.source)
+			probeLimit.WithLabelValues(username, l.source, l.registry, l.policy).Set(float64(l.limit))
+			probeRemaining.WithLabelValues(username, l.source, l.registry, l.policy).Set(float64(l.remaining))
+			probeLimitWindow.WithLabelValues(username, l.source, l.registry, l.policy).Set(float64(l.limitWindow))
+			probeRemainingWindow.WithLabelValues(username, l.source, l.registry, l.policy).Set(float64(l.remainingWindow))
+			for _, w := range l.windows {
+				window := strconv.Itoa(w.window)
+				probeWindowLimit.WithLabelValues(username, l.source, l.registry, w.policy, window).Set(float64(w.limit))
+				probeWindowRemaining.WithLabelValues(username, l.source, l.registry, w.policy, window).Set(float64(w.remaining))
+			}
+			probeSuccess.Set(1)
+		}
+
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
+
+// probeTarget resolves the credential to probe from the request parameters.
+// It also returns the alias to report anonymous credentials under.
+func probeTarget(config configuration, r *http.Request) (credentials, string, error) {
+	if module := r.URL.Query().Get("module"); module != "" {
+		credential, ok := config.Modules[module]
+		if !ok {
+			return credentials{}, "", fmt.Errorf("unknown module %q", module)
+		}
+		return credential, module, nil
+	}
+
+	account := r.URL.Query().Get("account")
+	if account == "" {
+		return credentials{}, "", fmt.Errorf("account or module parameter is missing")
+	}
+	for _, credential := range config.Credentials {
+		if credential.Anonymous && account == config.AnonymousAlias {
+			return credential, config.AnonymousAlias, nil
+		}
+		if !credential.Anonymous && credential.Username == account {
+			return credential, "", nil
+		}
+	}
+	return credentials{}, "", fmt.Errorf("unknown account %q", account)
+}
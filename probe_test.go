@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeHandler(t *testing.T) {
+	newFakeDockerHub(t, "100;w=21600", "42;w=21600")
+	config := configuration{
+		Credentials: []credentials{
+			{Username: "user1", Password: "password1"},
+			{Anonymous: true},
+		},
+		AnonymousAlias: "server001",
+		Modules: map[string]credentials{
+			"anonymous_eu": {Anonymous: true},
+		},
+		Timeout: time.Second,
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		want       []string
+	}{
+		{
+			name:       "When an account is probed then its metrics are returned",
+			query:      "account=user1",
+			wantStatus: http.StatusOK,
+			want: []string{
+				"probe_success 1",
+				`dockerhub_pull_limit_total{account="user1",policy="",registry="dockerhub",source="6f3b2c1a-0d4e-4f5a-9b8c-7d6e5f4a3b2c"} 100`,
+				`dockerhub_pull_remaining_total{account="user1",policy="",registry="dockerhub",source="6f3b2c1a-0d4e-4f5a-9b8c-7d6e5f4a3b2c"} 42`,
+				`dockerhub_pull_remaining_window_seconds{account="user1",policy="",registry="dockerhub",source="6f3b2c1a-0d4e-4f5a-9b8c-7d6e5f4a3b2c"} 21600`,
+			},
+		},
+		{
+			name:       "When the anonymous alias is probed then it is reported under the alias",
+			query:      "account=server001",
+			wantStatus: http.StatusOK,
+			want:       []string{`dockerhub_pull_remaining_total{account="server001",policy="",registry="dockerhub",source="192.0.2.1"} 42`},
+		},
+		{
+			name:       "When a module is probed then it is reported under the module name",
+			query:      "module=anonymous_eu",
+			wantStatus: http.StatusOK,
+			want:       []string{`dockerhub_pull_limit_total{account="anonymous_eu",policy="",registry="dockerhub",source="192.0.2.1"} 100`},
+		},
+		{
+			name:       "When the account is unknown then the request is rejected",
+			query:      "account=nobody",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "When no target is given then the request is rejected",
+			query:      "",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			probeHandler(config)(recorder, httptest.NewRequest(http.MethodGet, "/probe?"+tt.query, nil))
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, recorder.Code)
+			}
+			body, _ := io.ReadAll(recorder.Body)
+			for _, want := range tt.want {
+				if !strings.Contains(string(body), want) {
+					t.Errorf("expected body to contain %q, got:\n%s", want, body)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeHandlerFailure(t *testing.T) {
+	newFakeDockerHub(t, "invalid", "invalid")
+	config := configuration{
+		Credentials: []credentials{{Username: "user1", Password: "password1"}},
+		Timeout:     time.Second,
+	}
+
+	recorder := httptest.NewRecorder()
+	probeHandler(config)(recorder, httptest.NewRequest(http.MethodGet, "/probe?account=user1", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+	body := recorder.Body.String()
+	if !strings.Contains(body, "probe_success 0") {
+		t.Errorf("expected probe_success 0, got:\n%s", body)
+	}
+	if strings.Contains(body, "dockerhub_pull_limit_total") {
+		t.Errorf("expected no limit metrics on failure, got:\n%s", body)
+	}
+}
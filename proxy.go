@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type proxyConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Listen is the address the proxy serves the registry API on.
+	Listen string `yaml:"listen"`
+	// Upstream is the registry pulls are forwarded to.
+	Upstream string `yaml:"upstream"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// manifestPath matches the manifest requests of the registry API, the only
+// ones Docker Hub counts as pulls.
+var manifestPath = regexp.MustCompile(`^/v2/(.+)/manifests/[^/]+$`)
+
+// pullProxy is a reverse proxy in front of Docker Hub that reads the limits
+// from the responses to the pulls going through it, instead of probing them.
+// A nil pullProxy does nothing.
+type pullProxy struct {
+	config         proxyConfig
+	anonymousAlias string
+	server         *http.Server
+}
+
+func newPullProxy(config configuration) (*pullProxy, error) {
+	if !config.Proxy.Enabled {
+		return nil, nil
+	}
+	proxyConfig := config.Proxy
+	if proxyConfig.Listen == "" {
+		proxyConfig.Listen = ":5000"
+	}
+	if proxyConfig.Upstream == "" {
+		proxyConfig.Upstream = "https://registry-1.docker.io"
+	}
+	if (proxyConfig.CertFile == "") != (proxyConfig.KeyFile == "") {
+		return nil, errors.New("proxy requires both cert_file and key_file")
+	}
+	upstream, err := url.Parse(proxyConfig.Upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pullProxy{config: proxyConfig, anonymousAlias: config.AnonymousAlias}
+	p.server = &http.Server{
+		Addr: proxyConfig.Listen,
+		Handler: &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(upstream)
+			},
+			ModifyResponse: p.observe,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return p, nil
+}
+
+// start serves the proxy in the background.
+func (p *pullProxy) start() {
+	if p == nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"listen":   p.config.Listen,
+		"upstream": p.config.Upstream,
+	}).Info("Starting pull proxy")
+	go func() {
+		var err error
+		if p.config.CertFile != "" {
+			err = p.server.ListenAndServeTLS(p.config.CertFile, p.config.KeyFile)
+		} else {
+			err = p.server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start pull proxy: %v", err)
+		}
+	}()
+}
+
+// observe counts the pulls and records the limits of the manifest responses
+// going through the proxy.
+func (p *pullProxy) observe(resp *http.Response) error {
+	req := resp.Request
+	match := manifestPath.FindStringSubmatch(req.URL.Path)
+	if match == nil || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	// Only GET requests count as pulls, HEAD requests are free.
+	if req.Method == http.MethodGet {
+		proxyPulls.WithLabelValues(clientIP(req), match[1]).Inc()
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil
+	}
+
+	l, err := parseLimitsResponse(resp.Header)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"repository": match[1],
+		}).Warnf("Failed to read the limits of a proxied pull: %v", err)
+		return nil
+	}
+	l.registry = dockerHubRegistry
+	recordLimits(p.account(req, l.source), l, time.Now())
+	return nil
+}
+
+// account names the account a proxied pull was made with: the user the bearer
+// token was issued for, or the anonymous alias or source for anonymous pulls.
+func (p *pullProxy) account(req *http.Request, source string) string {
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		if claims, err := parseTokenClaims(token); err == nil {
+			if claims.DockerHub.Username != "" {
+				return claims.DockerHub.Username
+			}
+			if claims.Username != "" {
+				return claims.Username
+			}
+		}
+	}
+	return accountName(credentials{Anonymous: true}, p.anonymousAlias, source)
+}
+
+// clientIP returns the address of the client that sent the request to the
+// proxy.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
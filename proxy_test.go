@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newFakeUpstream serves manifests like Docker Hub, with the remaining pulls
+// of the source that made the request.
+func newFakeUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		case "Bearer anonymous-token":
+			w.Header().Set("docker-ratelimit-source", "192.0.2.1")
+			w.Header().Set("ratelimit-limit", "100;w=21600")
+			w.Header().Set("ratelimit-remaining", "7;w=21600")
+		default:
+			w.Header().Set("docker-ratelimit-source", fakeUserID)
+			w.Header().Set("ratelimit-limit", "200;w=21600")
+			w.Header().Set("ratelimit-remaining", "42;w=21600")
+		}
+		if r.URL.Path == "/v2/library/nginx/blobs/sha256:0123" {
+			_, _ = w.Write([]byte("layer"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		_, _ = w.Write([]byte(`{"schemaVersion":2}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPullProxy(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	p, err := newPullProxy(configuration{
+		AnonymousAlias: "proxy-anonymous",
+		Proxy:          proxyConfig{Enabled: true, Upstream: upstream.URL},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	proxy := httptest.NewServer(p.server.Handler)
+	t.Cleanup(proxy.Close)
+
+	request := func(method, path, token string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, proxy.URL+path, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	nginx := proxyPulls.WithLabelValues("127.0.0.1", "library/nginx")
+	grafana := proxyPulls.WithLabelValues("127.0.0.1", "grafana/grafana")
+	nginxBefore, grafanaBefore := testutil.ToFloat64(nginx), testutil.ToFloat64(grafana)
+
+	challenge := request(http.MethodGet, "/v2/library/nginx/manifests/latest", "")
+	if challenge.StatusCode != http.StatusUnauthorized || challenge.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("expected the authentication challenge to be forwarded, got %d", challenge.StatusCode)
+	}
+	request(http.MethodGet, "/v2/library/nginx/manifests/latest", fakeJWT("proxy-user"))
+	request(http.MethodGet, "/v2/library/nginx/manifests/1.27", fakeJWT("proxy-user"))
+	request(http.MethodHead, "/v2/library/nginx/manifests/latest", fakeJWT("proxy-user"))
+	request(http.MethodGet, "/v2/library/nginx/blobs/sha256:0123", fakeJWT("proxy-user"))
+	request(http.MethodGet, "/v2/grafana/grafana/manifests/latest", "anonymous-token")
+
+	if got := testutil.ToFloat64(nginx) - nginxBefore; got != 2 {
+		t.Errorf("expected 2 pulls of library/nginx, got %f", got)
+	}
+	if got := testutil.ToFloat64(grafana) - grafanaBefore; got != 1 {
+		t.Errorf("expected 1 pull of grafana/grafana, got %f", got)
+	}
+	if got := testutil.ToFloat64(pullRemaining.WithLabelValues("proxy-user", fakeUserID, "dockerhub", "")); got != 42 {
+		t.Errorf("expected 42 remaining pulls for the token's user, got %f", got)
+	}
+	if got := testutil.ToFloat64(pullRemaining.WithLabelValues("proxy-anonymous", "192.0.2.1", "dockerhub", "")); got != 7 {
+		t.Errorf("expected 7 remaining anonymous pulls, got %f", got)
+	}
+}
+
+func TestPullProxyDisabled(t *testing.T) {
+	p, err := newPullProxy(configuration{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if p != nil {
+		t.Fatal("expected no proxy when disabled")
+	}
+	p.start()
+}
+
+func TestPullProxyRequiresCertificateAndKey(t *testing.T) {
+	if _, err := newPullProxy(configuration{Proxy: proxyConfig{Enabled: true, CertFile: "proxy.crt"}}); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
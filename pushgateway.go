@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/push"
+	log "github.com/sirupsen/logrus"
+)
+
+type pushgatewayConfig struct {
+	URL              string            `yaml:"url"`
+	Job              string            `yaml:"job"`
+	Grouping         map[string]string `yaml:"grouping"`
+	Username         string            `yaml:"username"`
+	Password         string            `yaml:"password"`
+	TLS              tlsConfig         `yaml:"tls"`
+	DeleteOnShutdown bool              `yaml:"delete_on_shutdown"`
+}
+
+// metricsPusher pushes the exporter metrics to a Pushgateway after every
+// collection cycle. A nil metricsPusher does nothing, so callers don't need to check
+// whether pushing is enabled.
+type metricsPusher struct {
+	pusher           *push.Pusher
+	deleteOnShutdown bool
+}
+
+func newMetricsPusher(config configuration) (*metricsPusher, error) {
+	if config.Pushgateway.URL == "" {
+		return nil, nil
+	}
+	client, err := newHTTPClient(config.Pushgateway.TLS, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	job := config.Pushgateway.Job
+	if job == "" {
+		job = "dockerhub_pull_limit_exporter"
+	}
+	pusher := push.New(config.Pushgateway.URL, job).Client(client)
+	for name, value := range config.Pushgateway.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	if config.Pushgateway.Username != "" {
+		pusher = pusher.BasicAuth(config.Pushgateway.Username, config.Pushgateway.Password)
+	}
+	for _, gauge := range limitGauges {
+		pusher = pusher.Collector(gauge)
+	}
+	pusher = pusher.Collector(errorsCount)
+	pusher = pusher.Collector(authFailuresCount)
+	pusher = pusher.Collector(anonymousFallbackCount)
+
+	return &metricsPusher{
+		pusher:           pusher,
+		deleteOnShutdown: config.Pushgateway.DeleteOnShutdown,
+	}, nil
+}
+
+func (p *metricsPusher) push() {
+	if p == nil {
+		return
+	}
+	if err := p.pusher.Push(); err != nil {
+		log.Errorf("Failed to push metrics to the Pushgateway: %v", err)
+		return
+	}
+	log.Debug("Successfully pushed metrics to the Pushgateway")
+}
+
+// shutdown deletes the metrics group from the Pushgateway if configured to.
+func (p *metricsPusher) shutdown() {
+	if p == nil || !p.deleteOnShutdown {
+		return
+	}
+	if err := p.pusher.Delete(); err != nil {
+		log.Errorf("Failed to delete metrics from the Pushgateway: %v", err)
+		return
+	}
+	log.Info("Deleted metrics from the Pushgateway")
+}
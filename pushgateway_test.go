@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMetricsPusher(t *testing.T) {
+	var mutex sync.Mutex
+	var requests []string
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		username, password, _ := r.BasicAuth()
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+username+":"+password)
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pusher, err := newMetricsPusher(configuration{
+		Timeout: time.Second,
+		Pushgateway: pushgatewayConfig{
+			URL:              server.URL,
+			Grouping:         map[string]string{"instance": "server001"},
+			Username:         "push",
+			Password:         "secret",
+			DeleteOnShutdown: true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	pullRemaining.WithLabelValues("pushed", "192.0.2.1", "dockerhub", "").Set(42)
+	authFailuresCount.WithLabelValues("pushed", "dockerhub")
+	anonymousFallbackCount.WithLabelValues("pushed", "dockerhub")
+	pusher.push()
+	pusher.shutdown()
+
+	want := []string{
+		"PUT /metrics/job/dockerhub_pull_limit_exporter/instance/server001 push:secret",
+		"DELETE /metrics/job/dockerhub_pull_limit_exporter/instance/server001 push:secret",
+	}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("expected requests %v, got %v", want, requests)
+	}
+	for _, name := range []string{"dockerhub_pull_remaining_total", "dockerhub_pull_auth_failures_total", "dockerhub_pull_anonymous_fallbacks_total"} {
+		if !strings.Contains(body, name) {
+			t.Errorf("expected %s to be pushed", name)
+		}
+	}
+}
+
+func TestMetricsPusherDisabled(t *testing.T) {
+	pusher, err := newMetricsPusher(configuration{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if pusher != nil {
+		t.Fatalf("expected no pusher when no URL is configured")
+	}
+	pusher.push()
+	pusher.shutdown()
+}
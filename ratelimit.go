@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// rateLimitItem is a member of a RateLimit or RateLimit-Policy structured field
+// list: a policy name followed by its parameters.
+type rateLimitItem struct {
+	name   string
+	params map[string]string
+}
+
+// integer returns a non-negative integer parameter of the item.
+func (i rateLimitItem) integer(key string) (int, bool, error) {
+	value, ok := i.params[key]
+	if !ok {
+		return 0, false, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return 0, false, fmt.Errorf("invalid parameter %s=%q for policy %q", key, value, i.name)
+	}
+	return parsed, true, nil
+}
+
+// parseStructuredLimits reads the limits from the IETF RateLimit-Policy and
+// RateLimit headers, as in
+//
+//	RateLimit-Policy: "default";q=100;w=21600
+//	RateLimit: "default";r=42;t=3600
+//
+// It reports false when the response doesn't use them, so the legacy headers
+// can be read instead.
+func parseStructuredLimits(header http.Header) (limits, bool, error) {
+	policyHeader := header.Values("RateLimit-Policy")
+	if len(policyHeader) == 0 {
+		return limits{}, false, nil
+	}
+	policies, err := parseRateLimitList(strings.Join(policyHeader, ","))
+	if err != nil {
+		return limits{}, true, fmt.Errorf("failed to parse RateLimit-Policy: %w", err)
+	}
+	current, err := parseRateLimitList(strings.Join(header.Values("RateLimit"), ","))
+	if err != nil {
+		return limits{}, true, fmt.Errorf("failed to parse RateLimit: %w", err)
+	}
+	if len(current) == 0 {
+		return limits{}, true, errors.New("RateLimit header is missing")
+	}
+
+	// Every policy the server reports the remaining quota for applies to the
+	// request, and the most restrictive one is the headline.
+	var windows []windowLimits
+	resets := map[string]int{}
+	for _, item := range current {
+		window, reset, err := structuredWindow(policies, item)
+		if err != nil {
+			return limits{}, true, err
+		}
+		windows = append(windows, window)
+		resets[window.policy] = reset
+	}
+
+	headline := mostRestrictive(windows)
+	return limits{
+		limit:           headline.limit,
+		remaining:       headline.remaining,
+		limitWindow:     headline.window,
+		remainingWindow: headline.window,
+		reset:           resets[headline.policy],
+		policy:          headline.policy,
+		windows:         windows,
+	}, true, nil
+}
+
+// structuredWindow combines a RateLimit item with its policy and returns it
+// together with the seconds until it resets.
+func structuredWindow(policies []rateLimitItem, item rateLimitItem) (windowLimits, int, error) {
+	var policy *rateLimitItem
+	for i := range policies {
+		if policies[i].name == item.name {
+			policy = &policies[i]
+			break
+		}
+	}
+	if policy == nil {
+		return windowLimits{}, 0, fmt.Errorf("RateLimit-Policy does not contain policy %q", item.name)
+	}
+
+	quota, ok, err := policy.integer("q")
+	if err != nil {
+		return windowLimits{}, 0, err
+	}
+	if !ok {
+		return windowLimits{}, 0, fmt.Errorf("policy %q has no quota", policy.name)
+	}
+	window, _, err := policy.integer("w")
+	if err != nil {
+		return windowLimits{}, 0, err
+	}
+	remaining, ok, err := item.integer("r")
+	if err != nil {
+		return windowLimits{}, 0, err
+	}
+	if !ok {
+		return windowLimits{}, 0, fmt.Errorf("policy %q has no remaining quota", item.name)
+	}
+	reset, _, err := item.integer("t")
+	if err != nil {
+		return windowLimits{}, 0, err
+	}
+	return windowLimits{policy: policy.name, window: window, limit: quota, remaining: remaining}, reset, nil
+}
+
+// parseRateLimitList parses a structured field list (RFC 8941) whose members
+// are strings or tokens with parameters. Inner lists are not supported.
+func parseRateLimitList(field string) ([]rateLimitItem, error) {
+	p := &structuredFieldParser{input: field}
+	var items []rateLimitItem
+	p.skipSpaces()
+	for !p.done() {
+		item, err := p.parseItem()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+
+		p.skipSpaces()
+		if p.done() {
+			break
+		}
+		if p.input[p.position] != ',' {
+			return nil, fmt.Errorf("expected ',' at position %d", p.position)
+		}
+		p.position++
+		p.skipSpaces()
+		if p.done() {
+			return nil, errors.New("trailing ',' in list")
+		}
+	}
+	return items, nil
+}
+
+type structuredFieldParser struct {
+	input    string
+	position int
+}
+
+func (p *structuredFieldParser) done() bool {
+	return p.position >= len(p.input)
+}
+
+func (p *structuredFieldParser) skipSpaces() {
+	for !p.done() && (p.input[p.position] == ' ' || p.input[p.position] == '\t') {
+		p.position++
+	}
+}
+
+func (p *structuredFieldParser) parseItem() (rateLimitItem, error) {
+	name, err := p.parseBareItem()
+	if err != nil {
+		return rateLimitItem{}, err
+	}
+	item := rateLimitItem{name: name, params: map[string]string{}}
+	for !p.done() && p.input[p.position] == ';' {
+		p.position++
+		p.skipSpaces()
+		key := p.parseKey()
+		if key == "" {
+			return rateLimitItem{}, fmt.Errorf("expected parameter key at position %d", p.position)
+		}
+		value := "?1"
+		if !p.done() && p.input[p.position] == '=' {
+			p.position++
+			value, err = p.parseBareItem()
+			if err != nil {
+				return rateLimitItem{}, err
+			}
+		}
+		item.params[key] = value
+	}
+	return item, nil
+}
+
+func (p *structuredFieldParser) parseKey() string {
+	start := p.position
+	for !p.done() {
+		c := p.input[p.position]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.' || c == '*') {
+			break
+		}
+		if p.position == start && !(c >= 'a' && c <= 'z' || c == '*') {
+			break
+		}
+		p.position++
+	}
+	return p.input[start:p.position]
+}
+
+// parseBareItem parses a string, token, integer, byte sequence or boolean and
+// returns its unquoted value.
+func (p *structuredFieldParser) parseBareItem() (string, error) {
+	if p.done() {
+		return "", errors.New("unexpected end of field")
+	}
+	c := p.input[p.position]
+	switch {
+	case c == '"':
+		return p.parseString()
+	case c == '-' || c >= '0' && c <= '9':
+		return p.parseWhile(func(c byte) bool { return c == '-' || c == '.' || c >= '0' && c <= '9' }), nil
+	case c == ':':
+		p.position++
+		value := p.parseWhile(func(c byte) bool {
+			return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '+' || c == '/' || c == '='
+		})
+		if p.done() || p.input[p.position] != ':' {
+			return "", fmt.Errorf("unterminated byte sequence at position %d", p.position)
+		}
+		p.position++
+		return value, nil
+	case c == '?':
+		p.position++
+		if p.done() || (p.input[p.position] != '0' && p.input[p.position] != '1') {
+			return "", fmt.Errorf("invalid boolean at position %d", p.position)
+		}
+		p.position++
+		return p.input[p.position-2 : p.position], nil
+	case c == '*' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		return p.parseWhile(isTokenChar), nil
+	default:
+		return "", fmt.Errorf("unexpected character %q at position %d", c, p.position)
+	}
+}
+
+func (p *structuredFieldParser) parseString() (string, error) {
+	p.position++
+	var value strings.Builder
+	for !p.done() {
+		c := p.input[p.position]
+		p.position++
+		switch {
+		case c == '\\':
+			if p.done() || (p.input[p.position] != '"' && p.input[p.position] != '\\') {
+				return "", fmt.Errorf("invalid escape at position %d", p.position)
+			}
+			value.WriteByte(p.input[p.position])
+			p.position++
+		case c == '"':
+			return value.String(), nil
+		case c < 0x20 || c > 0x7e:
+			return "", fmt.Errorf("invalid character in string at position %d", p.position-1)
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated string")
+}
+
+func (p *structuredFieldParser) parseWhile(accept func(c byte) bool) string {
+	start := p.position
+	for !p.done() && accept(p.input[p.position]) {
+		p.position++
+	}
+	return p.input[start:p.position]
+}
+
+func isTokenChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~:/", c) >= 0
+}
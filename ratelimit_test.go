@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseStructuredLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    []string
+		rateLimit []string
+		want      limits
+		wantOK    bool
+		wantErr   bool
+	}{
+		{
+			name:   "When the legacy headers are used then the structured parser is skipped",
+			wantOK: false,
+		},
+		{
+			name:      "When a single policy is sent then its quota and remaining pulls are read",
+			policy:    []string{`"default";q=100;w=21600`},
+			rateLimit: []string{`"default";r=42;t=3600`},
+			want: limits{limit: 100, remaining: 42, limitWindow: 21600, remainingWindow: 21600, reset: 3600, policy: "default",
+				windows: []windowLimits{{policy: "default", window: 21600, limit: 100, remaining: 42}}},
+			wantOK: true,
+		},
+		{
+			name:      "When several policies are sent then the one in RateLimit is used",
+			policy:    []string{`"burst";q=10;w=60, "daily";q=1000;w=86400`},
+			rateLimit: []string{`"daily";r=900;t=7200`},
+			want: limits{limit: 1000, remaining: 900, limitWindow: 86400, remainingWindow: 86400, reset: 7200, policy: "daily",
+				windows: []windowLimits{{policy: "daily", window: 86400, limit: 1000, remaining: 900}}},
+			wantOK: true,
+		},
+		{
+			name:      "When policies are split across header lines then they are combined",
+			policy:    []string{`"burst";q=10;w=60`, `"daily";q=1000;w=86400`},
+			rateLimit: []string{`"burst";r=3;t=20`},
+			want: limits{limit: 10, remaining: 3, limitWindow: 60, remainingWindow: 60, reset: 20, policy: "burst",
+				windows: []windowLimits{{policy: "burst", window: 60, limit: 10, remaining: 3}}},
+			wantOK: true,
+		},
+		{
+			name:      "When several policies have remaining quota then the most restrictive is the headline",
+			policy:    []string{`"burst";q=40;w=600, "sustained";q=200;w=21600`},
+			rateLimit: []string{`"burst";r=35;t=300, "sustained";r=12;t=9000`},
+			want: limits{limit: 200, remaining: 12, limitWindow: 21600, remainingWindow: 21600, reset: 9000, policy: "sustained",
+				windows: []windowLimits{
+					{policy: "burst", window: 600, limit: 40, remaining: 35},
+					{policy: "sustained", window: 21600, limit: 200, remaining: 12},
+				}},
+			wantOK: true,
+		},
+		{
+			name:      "When policy names are tokens then they are accepted",
+			policy:    []string{`default;q=100;w=21600;pk=:YWJj:`},
+			rateLimit: []string{`default;r=0`},
+			want: limits{limit: 100, remaining: 0, limitWindow: 21600, remainingWindow: 21600, policy: "default",
+				windows: []windowLimits{{policy: "default", window: 21600, limit: 100, remaining: 0}}},
+			wantOK: true,
+		},
+		{
+			name:      "When quoted names contain escapes then they are unescaped",
+			policy:    []string{`"pull \"limit\"";q=100`},
+			rateLimit: []string{`"pull \"limit\"";r=5`},
+			want: limits{limit: 100, remaining: 5, policy: `pull "limit"`,
+				windows: []windowLimits{{policy: `pull "limit"`, limit: 100, remaining: 5}}},
+			wantOK: true,
+		},
+		{
+			name:      "When unknown parameters are sent then they are ignored",
+			policy:    []string{`"default";q=100;w=21600;qu="requests";flag`},
+			rateLimit: []string{`"default";r=42;t=3600;pk="abc"`},
+			want: limits{limit: 100, remaining: 42, limitWindow: 21600, remainingWindow: 21600, reset: 3600, policy: "default",
+				windows: []windowLimits{{policy: "default", window: 21600, limit: 100, remaining: 42}}},
+			wantOK: true,
+		},
+		{
+			name:    "When RateLimit is missing then it fails",
+			policy:  []string{`"default";q=100;w=21600`},
+			wantOK:  true,
+			wantErr: true,
+		},
+		{
+			name:      "When RateLimit refers to an unknown policy then it fails",
+			policy:    []string{`"default";q=100;w=21600`},
+			rateLimit: []string{`"other";r=42`},
+			wantOK:    true,
+			wantErr:   true,
+		},
+		{
+			name:      "When the quota is missing then it fails",
+			policy:    []string{`"default";w=21600`},
+			rateLimit: []string{`"default";r=42`},
+			wantOK:    true,
+			wantErr:   true,
+		},
+		{
+			name:      "When the quota is negative then it fails",
+			policy:    []string{`"default";q=-1`},
+			rateLimit: []string{`"default";r=42`},
+			wantOK:    true,
+			wantErr:   true,
+		},
+		{
+			name:      "When a string is not terminated then it fails",
+			policy:    []string{`"default;q=100`},
+			rateLimit: []string{`"default";r=42`},
+			wantOK:    true,
+			wantErr:   true,
+		},
+		{
+			name:      "When the list has a trailing comma then it fails",
+			policy:    []string{`"default";q=100,`},
+			rateLimit: []string{`"default";r=42`},
+			wantOK:    true,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, value := range tt.policy {
+				header.Add("RateLimit-Policy", value)
+			}
+			for _, value := range tt.rateLimit {
+				header.Add("RateLimit", value)
+			}
+			got, ok, err := parseStructuredLimits(header)
+			if ok != tt.wantOK {
+				t.Fatalf("expected ok to be %v, got %v", tt.wantOK, ok)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseRateLimitList(t *testing.T) {
+	got, err := parseRateLimitList(`"a";q=1, b;w=2;x="y" ,  *c;z`)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := []rateLimitItem{
+		{name: "a", params: map[string]string{"q": "1"}},
+		{name: "b", params: map[string]string{"w": "2", "x": "y"}},
+		{name: "*c", params: map[string]string{"z": "?1"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
+
+func FuzzParseStructuredLimits(f *testing.F) {
+	f.Add(`"default";q=100;w=21600`, `"default";r=42;t=3600`)
+	f.Add(`"burst";q=10;w=60, "daily";q=1000;w=86400`, `"daily";r=900`)
+	f.Add(`default;q=100;pk=:YWJj:`, `default;r=0;t=0`)
+	f.Add(`"a\"b";q=1`, `"a\"b";r=1`)
+	f.Add(`"unterminated;q=1`, `;`)
+	f.Fuzz(func(t *testing.T, policy string, rateLimit string) {
+		header := http.Header{}
+		header.Set("RateLimit-Policy", policy)
+		header.Set("RateLimit", rateLimit)
+		l, ok, err := parseStructuredLimits(header)
+		if !ok {
+			t.Fatal("expected the structured headers to be detected")
+		}
+		if err != nil {
+			return
+		}
+		if l.limit < 0 || l.remaining < 0 || l.limitWindow < 0 || l.reset < 0 {
+			t.Errorf("expected non-negative limits, got %+v", l)
+		}
+	})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const dockerHubRegistry = "dockerhub"
+
+// registryConfig describes a registry that hands out bearer tokens the way the
+// Docker registry token specification does. The limits are read from the
+// headers of a HEAD request for Reference in Repository.
+type registryConfig struct {
+	URL             string `yaml:"url"`
+	Repository      string `yaml:"repository"`
+	Reference       string `yaml:"reference"`
+	LimitHeader     string `yaml:"limit_header"`
+	RemainingHeader string `yaml:"remaining_header"`
+	SourceHeader    string `yaml:"source_header"`
+}
+
+// registryDriver probes the pull rate limits of a registry with a credential.
+type registryDriver interface {
+	probe(credential credentials, timeout time.Duration) (limits, error)
+}
+
+var (
+	driversMutex sync.RWMutex
+	drivers      = map[string]registryDriver{dockerHubRegistry: dockerHubDriver{}}
+)
+
+// configureRegistries registers a driver for the registries defined in the
+// config file.
+func configureRegistries(registries map[string]registryConfig) error {
+	for name, registry := range registries {
+		if name == dockerHubRegistry {
+			return fmt.Errorf("registry %s can't be redefined", dockerHubRegistry)
+		}
+		if registry.URL == "" || registry.Repository == "" {
+			return fmt.Errorf("registry %s requires url and repository", name)
+		}
+	}
+
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+	for name, registry := range registries {
+		drivers[name] = newTokenRegistryDriver(registry)
+	}
+	return nil
+}
+
+// knownRegistry reports whether name is Docker Hub or one of registries.
+func knownRegistry(name string, registries map[string]registryConfig) bool {
+	if name == dockerHubRegistry {
+		return true
+	}
+	_, ok := registries[name]
+	return ok
+}
+
+func registryDriverFor(name string) (registryDriver, error) {
+	driversMutex.RLock()
+	defer driversMutex.RUnlock()
+	driver, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown registry %q", name)
+	}
+	return driver, nil
+}
+
+// dockerHubDriver probes Docker Hub through its dedicated rate limit preview
+// repository.
+type dockerHubDriver struct{}
+
+func (dockerHubDriver) probe(credential credentials, timeout time.Duration) (limits, error) {
+	token, err := getToken(credential.Username, credential.Password, timeout)
+	if err != nil {
+		return limits{}, err
+	}
+	if err := checkIdentity(credential, token); err != nil {
+		return limits{}, err
+	}
+	l, err := getLimits(token.token, timeout)
+	if err != nil {
+		return limits{}, err
+	}
+	l.tokenExpiry = token.expiresAt
+	l.userID = token.subject
+	return l, nil
+}
+
+// tokenRegistryDriver discovers how to authenticate from the challenge the
+// registry answers /v2/ with, either anonymously or exchanging the credential
+// for a bearer token, and then reads the limits from the manifest headers.
+type tokenRegistryDriver struct {
+	config registryConfig
+}
+
+func newTokenRegistryDriver(config registryConfig) tokenRegistryDriver {
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	if config.Reference == "" {
+		config.Reference = "latest"
+	}
+	if config.LimitHeader == "" {
+		config.LimitHeader = "ratelimit-limit"
+	}
+	if config.RemainingHeader == "" {
+		config.RemainingHeader = "ratelimit-remaining"
+	}
+	return tokenRegistryDriver{config: config}
+}
+
+func (d tokenRegistryDriver) probe(credential credentials, timeout time.Duration) (limits, error) {
+	client := &http.Client{Timeout: timeout}
+	authorization, tokenExpiry, err := d.authorize(client, credential)
+	if err != nil {
+		return limits{}, err
+	}
+
+	req, err := http.NewRequest("HEAD", fmt.Sprintf("%s/v2/%s/manifests/%s", d.config.URL, d.config.Repository, d.config.Reference), nil)
+	if err != nil {
+		return limits{}, err
+	}
+	req.Header.Set("Accept", strings.Join([]string{
+		"application/vnd.oci.image.index.v1+json",
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.docker.distribution.manifest.v2+json",
+	}, ", "))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return limits{}, err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Errorf("Error closing response body: %v", err)
+		}
+	}(resp.Body)
+
+	if resp.StatusCode == http.StatusUnauthorized && strings.HasPrefix(authorization, "Basic ") {
+		return limits{}, authFailedError(resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return limits{}, fmt.Errorf("failed to fetch limits: status code %d", resp.StatusCode)
+	}
+
+	source := ""
+	if d.config.SourceHeader != "" {
+		source = resp.Header.Get(d.config.SourceHeader)
+	}
+	if l, ok, err := parseStructuredLimits(resp.Header); ok {
+		l.source = source
+		l.tokenExpiry = tokenExpiry
+		return l, err
+	}
+
+	l, err := parseLimitHeaders(
+		d.config.LimitHeader, resp.Header.Get(d.config.LimitHeader),
+		d.config.RemainingHeader, resp.Header.Get(d.config.RemainingHeader),
+		false,
+	)
+	if err != nil {
+		return limits{}, err
+	}
+	l.source = source
+	l.tokenExpiry = tokenExpiry
+	return l, nil
+}
+
+// authorize returns the Authorization header to send to the registry, or an
+// empty string when the registry doesn't require one, and the expiry of the
+// bearer token if any.
+func (d tokenRegistryDriver) authorize(client *http.Client, credential credentials) (string, time.Time, error) {
+	resp, err := client.Get(d.config.URL + "/v2/")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Errorf("Error closing response body: %v", err)
+		}
+	}(resp.Body)
+
+	if resp.StatusCode == http.StatusOK {
+		return "", time.Time{}, nil
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return "", time.Time{}, fmt.Errorf("failed to check the registry API: status code %d", resp.StatusCode)
+	}
+
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if credential.Anonymous {
+			return "", time.Time{}, errors.New("registry requires credentials")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credential.Username+":"+credential.Password)), time.Time{}, nil
+	case "bearer":
+		token, err := d.fetchToken(client, params, credential)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return "Bearer " + token.token, token.expiresAt, nil
+	default:
+		return "", time.Time{}, fmt.Errorf("unsupported authentication challenge %q", scheme)
+	}
+}
+
+func (d tokenRegistryDriver) fetchToken(client *http.Client, params map[string]string, credential credentials) (authToken, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return authToken{}, fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", d.config.Repository))
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return authToken{}, err
+	}
+	if !credential.Anonymous && credential.Username != "" && credential.Password != "" {
+		req.SetBasicAuth(credential.Username, credential.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return authToken{}, err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Errorf("Error closing response body: %v", err)
+		}
+	}(resp.Body)
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return authToken{}, authFailedError(resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return authToken{}, fmt.Errorf("failed to fetch token: status code %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return authToken{}, err
+	}
+	return parseTokenResponse(body, time.Now())
+}
+
+// parseChallenge splits a WWW-Authenticate header such as
+// `Bearer realm="https://ghcr.io/token",service="ghcr.io"` into its scheme and
+// parameters.
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+	for rest != "" {
+		var key string
+		key, rest, _ = strings.Cut(rest, "=")
+		key = strings.ToLower(strings.TrimSpace(strings.TrimLeft(key, ", ")))
+
+		var value string
+		rest = strings.TrimSpace(rest)
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key != "" {
+			params[key] = strings.TrimSpace(value)
+		}
+	}
+	return scheme, params
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeRegistry serves the registry API behind the given authentication scheme:
+// bearer, basic or none.
+type fakeRegistry struct {
+	server  *httptest.Server
+	scheme  string
+	headers map[string]string
+	// tokenAuth is the Authorization header received by the token endpoint
+	tokenAuth  string
+	tokenScope string
+}
+
+func newFakeRegistry(t *testing.T, scheme string, headers map[string]string) *fakeRegistry {
+	t.Helper()
+	registry := &fakeRegistry{scheme: scheme, headers: headers}
+	authorized := func(r *http.Request) bool {
+		switch scheme {
+		case "bearer":
+			return r.Header.Get("Authorization") == "Bearer registry-token"
+		case "basic":
+			username, password, ok := r.BasicAuth()
+			return ok && username == "user1" && password == "password1"
+		}
+		return true
+	}
+	challenge := func(w http.ResponseWriter) {
+		switch scheme {
+		case "bearer":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake-registry"`, registry.server.URL))
+		case "basic":
+			w.Header().Set("WWW-Authenticate", `Basic realm="fake-registry"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			challenge(w)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		registry.tokenAuth = r.Header.Get("Authorization")
+		registry.tokenScope = r.URL.Query().Get("scope")
+		if r.URL.Query().Get("service") != "fake-registry" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"registry-token"}`))
+	})
+	mux.HandleFunc("/v2/library/busybox/manifests/latest", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			challenge(w)
+			return
+		}
+		for name, value := range registry.headers {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	registry.server = httptest.NewServer(mux)
+	t.Cleanup(registry.server.Close)
+	return registry
+}
+
+func TestTokenRegistryDriver(t *testing.T) {
+	tests := []struct {
+		name       string
+		scheme     string
+		credential credentials
+		config     registryConfig
+		headers    map[string]string
+		want       limits
+		wantErr    bool
+	}{
+		{
+			name:       "When the registry issues bearer tokens then the credential is exchanged for one",
+			scheme:     "bearer",
+			credential: credentials{Username: "user1", Password: "password1"},
+			headers:    map[string]string{"ratelimit-limit": "200;w=21600", "ratelimit-remaining": "150;w=21600"},
+			want: limits{limit: 200, remaining: 150, limitWindow: 21600, remainingWindow: 21600,
+				windows: []windowLimits{{window: 21600, limit: 200, remaining: 150}}},
+		},
+		{
+			name:       "When an anonymous credential is used then a token is requested without credentials",
+			scheme:     "bearer",
+			credential: credentials{Anonymous: true},
+			headers:    map[string]string{"ratelimit-limit": "100;w=21600", "ratelimit-remaining": "90;w=21600"},
+			want: limits{limit: 100, remaining: 90, limitWindow: 21600, remainingWindow: 21600,
+				windows: []windowLimits{{window: 21600, limit: 100, remaining: 90}}},
+		},
+		{
+			name:       "When the registry uses basic authentication then the credential is sent as is",
+			scheme:     "basic",
+			credential: credentials{Username: "user1", Password: "password1"},
+			headers:    map[string]string{"ratelimit-limit": "100", "ratelimit-remaining": "10"},
+			want:       limits{limit: 100, remaining: 10, windows: []windowLimits{{limit: 100, remaining: 10}}},
+		},
+		{
+			name:       "When the registry uses other header names then they are read from the config",
+			scheme:     "none",
+			credential: credentials{Anonymous: true},
+			config:     registryConfig{LimitHeader: "x-ratelimit-limit", RemainingHeader: "x-ratelimit-remaining", SourceHeader: "x-ratelimit-source"},
+			headers:    map[string]string{"x-ratelimit-limit": "5000", "x-ratelimit-remaining": "4999", "x-ratelimit-source": "192.0.2.1"},
+			want:       limits{limit: 5000, remaining: 4999, source: "192.0.2.1", windows: []windowLimits{{limit: 5000, remaining: 4999}}},
+		},
+		{
+			name:       "When the registry sends the IETF headers then they take precedence",
+			scheme:     "bearer",
+			credential: credentials{Username: "user1", Password: "password1"},
+			headers: map[string]string{
+				"ratelimit-limit":     "1;w=1",
+				"ratelimit-remaining": "1;w=1",
+				"RateLimit-Policy":    `"default";q=100;w=21600`,
+				"RateLimit":           `"default";r=42;t=3600`,
+			},
+			want: limits{limit: 100, remaining: 42, limitWindow: 21600, remainingWindow: 21600, reset: 3600, policy: "default",
+				windows: []windowLimits{{policy: "default", window: 21600, limit: 100, remaining: 42}}},
+		},
+		{
+			name:       "When an anonymous credential is used with basic authentication then it fails",
+			scheme:     "basic",
+			credential: credentials{Anonymous: true},
+			headers:    map[string]string{"ratelimit-limit": "100", "ratelimit-remaining": "10"},
+			wantErr:    true,
+		},
+		{
+			name:       "When the limit headers are missing then it fails",
+			scheme:     "bearer",
+			credential: credentials{Username: "user1", Password: "password1"},
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newFakeRegistry(t, tt.scheme, tt.headers)
+			config := tt.config
+			config.URL = registry.server.URL
+			config.Repository = "library/busybox"
+
+			got, err := newTokenRegistryDriver(config).probe(tt.credential, time.Second)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+			if tt.scheme != "bearer" {
+				return
+			}
+			if tt.credential.Anonymous && registry.tokenAuth != "" {
+				t.Errorf("expected no credentials to be sent for anonymous tokens, got %q", registry.tokenAuth)
+			}
+			if !tt.credential.Anonymous && registry.tokenAuth == "" {
+				t.Error("expected credentials to be sent for the token")
+			}
+			if registry.tokenScope != "repository:library/busybox:pull" {
+				t.Errorf("expected pull scope for the probed repository, got %q", registry.tokenScope)
+			}
+		})
+	}
+}
+
+func TestCollectMetricsFromRegistry(t *testing.T) {
+	registry := newFakeRegistry(t, "bearer", map[string]string{"ratelimit-limit": "200;w=3600", "ratelimit-remaining": "120;w=3600"})
+	if err := configureRegistries(map[string]registryConfig{
+		"fake": {URL: registry.server.URL, Repository: "library/busybox"},
+	}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	l, err := collectMetrics(credentials{Username: "user1", Password: "password1", Registry: "fake"}, time.Second, "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if l.registry != "fake" {
+		t.Errorf("expected registry fake, got %q", l.registry)
+	}
+	if got := testutil.ToFloat64(pullRemaining.WithLabelValues("user1", "", "fake", "")); got != 120 {
+		t.Errorf("expected 120 remaining pulls for the fake registry, got %f", got)
+	}
+}
+
+func TestConfigureRegistriesRejectsInvalidRegistries(t *testing.T) {
+	tests := map[string]map[string]registryConfig{
+		"redefined Docker Hub": {"dockerhub": {URL: "https://registry.example.com", Repository: "library/busybox"}},
+		"missing url":          {"example": {Repository: "library/busybox"}},
+		"missing repository":   {"example": {URL: "https://registry.example.com"}},
+	}
+	for name, registries := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := configureRegistries(registries); err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		header     string
+		wantScheme string
+		wantParams map[string]string
+	}{
+		{
+			header:     `Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:user/image:pull"`,
+			wantScheme: "Bearer",
+			wantParams: map[string]string{"realm": "https://ghcr.io/token", "service": "ghcr.io", "scope": "repository:user/image:pull"},
+		},
+		{
+			header:     `Basic realm="Registry Realm"`,
+			wantScheme: "Basic",
+			wantParams: map[string]string{"realm": "Registry Realm"},
+		},
+		{
+			header:     `Bearer realm=https://auth.example.com/token, service=registry`,
+			wantScheme: "Bearer",
+			wantParams: map[string]string{"realm": "https://auth.example.com/token", "service": "registry"},
+		},
+		{
+			header:     ``,
+			wantScheme: "",
+			wantParams: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			scheme, params := parseChallenge(tt.header)
+			if scheme != tt.wantScheme {
+				t.Errorf("expected scheme %q, got %q", tt.wantScheme, scheme)
+			}
+			if !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("expected params %v, got %v", tt.wantParams, params)
+			}
+		})
+	}
+}
+
+func TestKnownRegistry(t *testing.T) {
+	registries := map[string]registryConfig{"harbor": {URL: "https://harbor.example.com", Repository: "library/busybox"}}
+	for name, want := range map[string]bool{"dockerhub": true, "harbor": true, "ghcr": false} {
+		if got := knownRegistry(name, registries); got != want {
+			t.Errorf("expected knownRegistry(%q) to be %v, got %v", name, want, got)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type registryLogsConfig struct {
+	// Path is the JSON access log of the upstream proxy, or - to read the logs
+	// from stdin, as in docker logs -f upstream | dockerhub-pull-limit-exporter.
+	Path string `yaml:"path"`
+	// Account labels the limits read from the logs, the anonymous alias or
+	// the source of the limits when empty.
+	Account string `yaml:"account"`
+}
+
+// registryLogTailer follows the JSON access log of an nginx proxy that forwards
+// the upstream requests of a registry:2 pull-through cache to Docker Hub. The
+// registry doesn't log the responses it gets from Docker Hub, but every
+// manifest the proxy fetched is a cache miss, and nginx can log the rate limit
+// headers of its responses. A nil registryLogTailer does nothing.
+type registryLogTailer struct {
+	config         registryLogsConfig
+	anonymousAlias string
+	stdin          io.Reader
+	pollInterval   time.Duration
+}
+
+func newRegistryLogTailer(config configuration) (*registryLogTailer, error) {
+	if config.RegistryLogs.Path == "" {
+		return nil, nil
+	}
+	return &registryLogTailer{
+		config:         config.RegistryLogs,
+		anonymousAlias: config.AnonymousAlias,
+		stdin:          os.Stdin,
+		pollInterval:   time.Second,
+	}, nil
+}
+
+// start follows the logs until ctx is done, or until stdin is closed.
+func (t *registryLogTailer) start(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"path": t.config.Path,
+	}).Info("Following registry logs")
+	go func() {
+		var err error
+		if t.config.Path == "-" {
+			err = t.read(t.stdin)
+		} else {
+			err = t.follow(ctx)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.WithFields(log.Fields{
+				"path": t.config.Path,
+			}).Errorf("Stopped following registry logs: %v", err)
+		}
+	}()
+}
+
+// read processes every line of r until it ends.
+func (t *registryLogTailer) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		t.process(scanner.Bytes())
+	}
+	return scanner.Err()
+}
+
+// follow processes the lines appended to the log file, starting at its end,
+// and reopens it when it is rotated or truncated.
+func (t *registryLogTailer) follow(ctx context.Context) error {
+	file, err := os.Open(t.config.Path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	var line []byte
+	for {
+		chunk, err := reader.ReadBytes('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			t.process(line)
+			line = line[:0]
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(t.pollInterval):
+		}
+		if rotated, err := logRotated(file, t.config.Path); err != nil {
+			return err
+		} else if rotated {
+			_ = file.Close()
+			if file, err = os.Open(t.config.Path); err != nil {
+				return err
+			}
+			reader.Reset(file)
+			line = line[:0]
+		}
+	}
+}
+
+// logRotated reports whether the file at path was replaced or truncated since
+// file was opened.
+func logRotated(file *os.File, path string) (bool, error) {
+	current, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// The new file isn't created yet.
+			return false, nil
+		}
+		return false, err
+	}
+	opened, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !os.SameFile(current, opened) {
+		return true, nil
+	}
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	return current.Size() < offset, nil
+}
+
+// upstreamLogEntry is a line of the JSON access log of the nginx proxy between
+// the pull-through cache and Docker Hub, written with the log_format in the
+// README. nginx logs every variable as a string, and the headers Docker Hub
+// didn't send as empty strings.
+type upstreamLogEntry struct {
+	Time               string `json:"time"`
+	Method             string `json:"method"`
+	URI                string `json:"uri"`
+	Status             string `json:"status"`
+	RateLimitLimit     string `json:"ratelimit_limit"`
+	RateLimitRemaining string `json:"ratelimit_remaining"`
+	RateLimitSource    string `json:"ratelimit_source"`
+}
+
+// process reads a log line and records the limits of the manifests fetched
+// from Docker Hub.
+func (t *registryLogTailer) process(line []byte) {
+	var entry upstreamLogEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return
+	}
+	uri, err := url.ParseRequestURI(entry.URI)
+	if err != nil {
+		return
+	}
+	match := manifestPath.FindStringSubmatch(uri.Path)
+	// Token challenges and missing manifests don't carry the limits.
+	if match == nil || entry.Status != strconv.Itoa(http.StatusOK) {
+		return
+	}
+	// Every request the proxy logs went to Docker Hub. Only GET requests count
+	// as pulls, HEAD requests are free.
+	switch entry.Method {
+	case http.MethodGet:
+		cacheMisses.WithLabelValues(match[1]).Inc()
+	case http.MethodHead:
+	default:
+		return
+	}
+
+	header := http.Header{}
+	header.Set("ratelimit-limit", entry.RateLimitLimit)
+	header.Set("ratelimit-remaining", entry.RateLimitRemaining)
+	header.Set("docker-ratelimit-source", entry.RateLimitSource)
+	l, err := parseLimitsResponse(header)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"repository": match[1],
+		}).Warnf("Failed to read the limits from the upstream logs: %v", err)
+		return
+	}
+	l.registry = dockerHubRegistry
+
+	now := time.Now()
+	if logged, err := time.Parse(time.RFC3339, entry.Time); err == nil {
+		now = logged
+	}
+	account := t.config.Account
+	if account == "" {
+		account = accountName(credentials{Anonymous: true}, t.anonymousAlias, l.source)
+	}
+	recordLimits(account, l, now)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// upstreamManifestLog is a manifest fetch logged by nginx with the log_format
+// documented in the README.
+const upstreamManifestLog = `{"time":"2026-01-01T00:00:00+00:00","method":"GET",` +
+	`"uri":"/v2/library/nginx/manifests/sha256:4c0fdaa8b6341bfdeca5f18f7837462c80cff90527ee35ef185571e1c327beac",` +
+	`"status":"200","ratelimit_limit":"100;w=21600","ratelimit_remaining":"57;w=21600","ratelimit_source":"192.0.2.1"}`
+
+func TestRegistryLogTailerReadsUpstreamManifests(t *testing.T) {
+	tailer, err := newRegistryLogTailer(configuration{RegistryLogs: registryLogsConfig{Path: "-", Account: "cache"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	logs := strings.Join([]string{
+		// The token challenge sent before the fetch has no limits.
+		`{"time":"2026-01-01T00:00:00+00:00","method":"HEAD","uri":"/v2/library/nginx/manifests/latest",` +
+			`"status":"401","ratelimit_limit":"","ratelimit_remaining":"","ratelimit_source":""}`,
+		// The cache resolves the tag with a HEAD request, which is not a pull.
+		`{"time":"2026-01-01T00:00:00+00:00","method":"HEAD","uri":"/v2/library/nginx/manifests/latest",` +
+			`"status":"200","ratelimit_limit":"100;w=21600","ratelimit_remaining":"58;w=21600","ratelimit_source":"192.0.2.1"}`,
+		upstreamManifestLog,
+		// Blobs are redirected to the CDN and don't count.
+		`{"time":"2026-01-01T00:00:01+00:00","method":"GET","uri":"/v2/library/nginx/blobs/sha256:0123",` +
+			`"status":"307","ratelimit_limit":"","ratelimit_remaining":"","ratelimit_source":""}`,
+		`{"time":"2026-01-01T00:00:01+00:00","method":"GET","uri":"/v2/org/app/manifests/latest",` +
+			`"status":"404","ratelimit_limit":"","ratelimit_remaining":"","ratelimit_source":""}`,
+		`not json`,
+	}, "\n")
+	nginx, app := cacheMisses.WithLabelValues("library/nginx"), cacheMisses.WithLabelValues("org/app")
+	nginxBefore, appBefore := testutil.ToFloat64(nginx), testutil.ToFloat64(app)
+	if err := tailer.read(strings.NewReader(logs)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if got := testutil.ToFloat64(nginx) - nginxBefore; got != 1 {
+		t.Errorf("expected 1 cache miss, got %f", got)
+	}
+	if got := testutil.ToFloat64(app) - appBefore; got != 0 {
+		t.Errorf("expected failed fetches to be ignored, got %f", got)
+	}
+	if got := testutil.ToFloat64(pullRemaining.WithLabelValues("cache", "192.0.2.1", "dockerhub", "")); got != 57 {
+		t.Errorf("expected 57 remaining pulls, got %f", got)
+	}
+	want := float64(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Unix())
+	if got := testutil.ToFloat64(lastSuccessTimestamp.WithLabelValues("cache", "192.0.2.1", "dockerhub", "")); got != want {
+		t.Errorf("expected the time of the log line %f, got %f", want, got)
+	}
+}
+
+func TestRegistryLogTailerFollowsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.log")
+	if err := os.WriteFile(path, []byte(strings.Replace(upstreamManifestLog, "57;", "99;", 1)+"\n"), 0o644); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	tailer, err := newRegistryLogTailer(configuration{RegistryLogs: registryLogsConfig{Path: path, Account: "followed"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	tailer.pollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = tailer.follow(ctx) }()
+
+	remaining := func() float64 {
+		return testutil.ToFloat64(pullRemaining.WithLabelValues("followed", "192.0.2.1", "dockerhub", ""))
+	}
+	appendLine := func(line string) {
+		t.Helper()
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		defer func() { _ = file.Close() }()
+		if _, err := file.WriteString(line); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	// Give the tailer time to open the file, so the line below is appended.
+	time.Sleep(50 * time.Millisecond)
+	appendLine(strings.Replace(upstreamManifestLog, "57;", "50;", 1) + "\n")
+	waitFor(t, 5*time.Second, func() bool { return remaining() == 50 })
+
+	// A line written in two parts is only read once complete.
+	line := strings.Replace(upstreamManifestLog, "57;", "40;", 1)
+	appendLine(line[:40])
+	time.Sleep(50 * time.Millisecond)
+	appendLine(line[40:] + "\n")
+	waitFor(t, 5*time.Second, func() bool { return remaining() == 40 })
+
+	// The file is read again from the start after it is rotated.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := os.WriteFile(path, []byte(strings.Replace(upstreamManifestLog, "57;", "30;", 1)+"\n"), 0o644); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return remaining() == 30 })
+}
+
+func TestRegistryLogTailerDisabled(t *testing.T) {
+	tailer, err := newRegistryLogTailer(configuration{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if tailer != nil {
+		t.Fatal("expected no tailer when disabled")
+	}
+	tailer.start(context.Background())
+}
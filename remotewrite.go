@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type remoteWriteConfig struct {
+	URL               string            `yaml:"url"`
+	BearerToken       string            `yaml:"bearer_token"`
+	Username          string            `yaml:"username"`
+	Password          string            `yaml:"password"`
+	Headers           map[string]string `yaml:"headers"`
+	TLS               tlsConfig         `yaml:"tls"`
+	ExternalLabels    map[string]string `yaml:"external_labels"`
+	FlushInterval     time.Duration     `yaml:"flush_interval"`
+	MaxSamplesPerSend int               `yaml:"max_samples_per_send"`
+	QueueCapacity     int               `yaml:"queue_capacity"`
+	MaxRetries        int               `yaml:"max_retries"`
+	MinBackoff        time.Duration     `yaml:"min_backoff"`
+}
+
+type timeSeries struct {
+	labels    []label
+	value     float64
+	timestamp int64
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+// errUnrecoverable marks remote write responses that won't succeed if retried,
+// so the batch is dropped instead of kept in the queue.
+var errUnrecoverable = errors.New("unrecoverable remote write error")
+
+// remoteWriter queues the samples of every collection and sends them in batches
+// to a Prometheus remote_write endpoint. Samples stay queued while the endpoint
+// is unreachable, up to the queue capacity. A nil remoteWriter does nothing.
+type remoteWriter struct {
+	config   remoteWriteConfig
+	client   *http.Client
+	gatherer prometheus.Gatherer
+
+	mutex sync.Mutex
+	queue []timeSeries
+
+	sending sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newRemoteWriter(config configuration) (*remoteWriter, error) {
+	if config.RemoteWrite.URL == "" {
+		return nil, nil
+	}
+	client, err := newHTTPClient(config.RemoteWrite.TLS, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	writeConfig := config.RemoteWrite
+	if writeConfig.FlushInterval == 0 {
+		writeConfig.FlushInterval = 10 * time.Second
+	}
+	if writeConfig.MaxSamplesPerSend == 0 {
+		writeConfig.MaxSamplesPerSend = 500
+	}
+	if writeConfig.QueueCapacity == 0 {
+		writeConfig.QueueCapacity = 10000
+	}
+	if writeConfig.MaxRetries == 0 {
+		writeConfig.MaxRetries = 3
+	}
+	if writeConfig.MinBackoff == 0 {
+		writeConfig.MinBackoff = time.Second
+	}
+
+	registry := prometheus.NewRegistry()
+	for _, gauge := range limitGauges {
+		registry.MustRegister(gauge)
+	}
+	registry.MustRegister(errorsCount)
+	registry.MustRegister(authFailuresCount)
+	registry.MustRegister(anonymousFallbackCount)
+
+	return &remoteWriter{
+		config:   writeConfig,
+		client:   client,
+		gatherer: registry,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// start sends the queued samples every flush interval until shutdown.
+func (w *remoteWriter) start() {
+	if w == nil {
+		return
+	}
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(w.config.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.flush()
+			case <-w.stop:
+				w.flush()
+				return
+			}
+		}
+	}()
+}
+
+// enqueue snapshots the current metric values with the current timestamp.
+func (w *remoteWriter) enqueue() {
+	if w == nil {
+		return
+	}
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		log.Errorf("Failed to gather metrics for remote write: %v", err)
+		return
+	}
+	series := w.toTimeSeries(families, time.Now())
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.queue = append(w.queue, series...)
+	if dropped := len(w.queue) - w.config.QueueCapacity; dropped > 0 {
+		log.Warnf("Remote write queue is full, dropping %d samples", dropped)
+		w.queue = w.queue[dropped:]
+	}
+}
+
+func (w *remoteWriter) toTimeSeries(families []*dto.MetricFamily, now time.Time) []timeSeries {
+	var series []timeSeries
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			var value float64
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			default:
+				continue
+			}
+			labels := []label{{name: "__name__", value: family.GetName()}}
+			for _, pair := range m.GetLabel() {
+				labels = append(labels, label{name: pair.GetName(), value: pair.GetValue()})
+			}
+			for name, labelValue := range w.config.ExternalLabels {
+				labels = append(labels, label{name: name, value: labelValue})
+			}
+			sort.Slice(labels, func(i, j int) bool {
+				return labels[i].name < labels[j].name
+			})
+			series = append(series, timeSeries{labels: labels, value: value, timestamp: now.UnixMilli()})
+		}
+	}
+	return series
+}
+
+// flush sends the queued samples in batches. A batch that keeps failing after
+// the retries stays in the queue for the next flush.
+func (w *remoteWriter) flush() {
+	w.sending.Lock()
+	defer w.sending.Unlock()
+	for {
+		w.mutex.Lock()
+		size := min(len(w.queue), w.config.MaxSamplesPerSend)
+		batch := append([]timeSeries(nil), w.queue[:size]...)
+		w.mutex.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+
+		err := w.sendWithRetries(batch)
+		if err != nil && !errors.Is(err, errUnrecoverable) {
+			log.Errorf("Failed to send samples to remote write, keeping them queued: %v", err)
+			return
+		}
+		if err != nil {
+			log.Errorf("Dropping %d samples rejected by remote write: %v", len(batch), err)
+		}
+
+		w.mutex.Lock()
+		w.queue = w.queue[min(size, len(w.queue)):]
+		w.mutex.Unlock()
+	}
+}
+
+func (w *remoteWriter) sendWithRetries(batch []timeSeries) error {
+	body := snappy.Encode(nil, encodeWriteRequest(batch))
+	backoff := w.config.MinBackoff
+	var err error
+	for attempt := 0; attempt <= w.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-w.stop:
+				return err
+			}
+			backoff *= 2
+		}
+		err = w.send(body)
+		if err == nil || errors.Is(err, errUnrecoverable) {
+			return err
+		}
+		log.Debugf("Remote write attempt %d failed: %v", attempt+1, err)
+	}
+	return err
+}
+
+func (w *remoteWriter) send(body []byte) error {
+	req, err := http.NewRequest("POST", w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "dockerhub-pull-limit-exporter/"+Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for name, value := range w.config.Headers {
+		req.Header.Set(name, value)
+	}
+	if w.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.config.BearerToken)
+	} else if w.config.Username != "" {
+		req.SetBasicAuth(w.config.Username, w.config.Password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Errorf("Error closing response body: %v", err)
+		}
+	}(resp.Body)
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("status code %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %v", errUnrecoverable, err)
+	}
+	return err
+}
+
+// shutdown sends the remaining samples before returning.
+func (w *remoteWriter) shutdown() {
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	<-w.done
+}
+
+// encodeWriteRequest encodes the series as a prometheus.WriteRequest protobuf
+// message, with one sample per series.
+func encodeWriteRequest(series []timeSeries) []byte {
+	var request []byte
+	for _, s := range series {
+		var encoded []byte
+		for _, l := range s.labels {
+			var labelBytes []byte
+			labelBytes = protowire.AppendTag(labelBytes, 1, protowire.BytesType)
+			labelBytes = protowire.AppendString(labelBytes, l.name)
+			labelBytes = protowire.AppendTag(labelBytes, 2, protowire.BytesType)
+			labelBytes = protowire.AppendString(labelBytes, l.value)
+			encoded = protowire.AppendTag(encoded, 1, protowire.BytesType)
+			encoded = protowire.AppendBytes(encoded, labelBytes)
+		}
+		var sampleBytes []byte
+		sampleBytes = protowire.AppendTag(sampleBytes, 1, protowire.Fixed64Type)
+		sampleBytes = protowire.AppendFixed64(sampleBytes, math.Float64bits(s.value))
+		sampleBytes = protowire.AppendTag(sampleBytes, 2, protowire.VarintType)
+		sampleBytes = protowire.AppendVarint(sampleBytes, uint64(s.timestamp))
+		encoded = protowire.AppendTag(encoded, 2, protowire.BytesType)
+		encoded = protowire.AppendBytes(encoded, sampleBytes)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, encoded)
+	}
+	return request
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type fakeRemoteWriteReceiver struct {
+	mutex  sync.Mutex
+	status int
+	auth   []string
+	series []timeSeries
+}
+
+func (f *fakeRemoteWriteReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	if f.status != http.StatusOK {
+		w.WriteHeader(f.status)
+		return
+	}
+	compressed, _ := io.ReadAll(r.Body)
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil || r.Header.Get("Content-Encoding") != "snappy" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.series = append(f.series, decodeWriteRequest(body)...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeRemoteWriteReceiver) setStatus(status int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.status = status
+}
+
+func (f *fakeRemoteWriteReceiver) received() []timeSeries {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]timeSeries(nil), f.series...)
+}
+
+func decodeWriteRequest(data []byte) []timeSeries {
+	var series []timeSeries
+	forEachField(data, func(_ protowire.Number, value []byte, _ uint64) {
+		var s timeSeries
+		forEachField(value, func(number protowire.Number, value []byte, _ uint64) {
+			switch number {
+			case 1:
+				var l label
+				forEachField(value, func(number protowire.Number, value []byte, _ uint64) {
+					if number == 1 {
+						l.name = string(value)
+					} else {
+						l.value = string(value)
+					}
+				})
+				s.labels = append(s.labels, l)
+			case 2:
+				forEachField(value, func(number protowire.Number, _ []byte, scalar uint64) {
+					if number == 1 {
+						s.value = math.Float64frombits(scalar)
+					} else {
+						s.timestamp = int64(scalar)
+					}
+				})
+			}
+		})
+		series = append(series, s)
+	})
+	return series
+}
+
+func forEachField(data []byte, fn func(number protowire.Number, value []byte, scalar uint64)) {
+	for len(data) > 0 {
+		number, typ, n := protowire.ConsumeTag(data)
+		data = data[n:]
+		switch typ {
+		case protowire.BytesType:
+			value, n := protowire.ConsumeBytes(data)
+			fn(number, value, 0)
+			data = data[n:]
+		case protowire.Fixed64Type:
+			value, n := protowire.ConsumeFixed64(data)
+			fn(number, nil, value)
+			data = data[n:]
+		case protowire.VarintType:
+			value, n := protowire.ConsumeVarint(data)
+			fn(number, nil, value)
+			data = data[n:]
+		default:
+			return
+		}
+	}
+}
+
+func newTestRemoteWriter(t *testing.T, receiver *fakeRemoteWriteReceiver, config remoteWriteConfig) *remoteWriter {
+	t.Helper()
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	config.URL = server.URL
+	config.MinBackoff = time.Millisecond
+	writer, err := newRemoteWriter(configuration{Timeout: time.Second, RemoteWrite: config})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return writer
+}
+
+func TestRemoteWriter(t *testing.T) {
+	receiver := &fakeRemoteWriteReceiver{status: http.StatusOK}
+	writer := newTestRemoteWriter(t, receiver, remoteWriteConfig{
+		BearerToken:    "secret",
+		ExternalLabels: map[string]string{"instance": "server001"},
+	})
+
+	pullRemaining.WithLabelValues("remote-write-user", "192.0.2.1", "dockerhub", "").Set(42)
+	authFailuresCount.WithLabelValues("remote-write-user", "dockerhub").Inc()
+	anonymousFallbackCount.WithLabelValues("remote-write-user", "dockerhub").Inc()
+	before := time.Now().UnixMilli()
+	writer.enqueue()
+	writer.flush()
+
+	if receiver.auth[0] != "Bearer secret" {
+		t.Errorf("expected bearer authentication, got %q", receiver.auth[0])
+	}
+	found := false
+	names := map[string]bool{}
+	for _, s := range receiver.received() {
+		labels := map[string]string{}
+		for _, l := range s.labels {
+			labels[l.name] = l.value
+		}
+		names[labels["__name__"]] = true
+		if labels["__name__"] != "dockerhub_pull_remaining_total" || labels["account"] != "remote-write-user" {
+			continue
+		}
+		found = true
+		if labels["instance"] != "server001" {
+			t.Errorf("expected external label instance=server001, got %v", labels)
+		}
+		if s.value != 42 {
+			t.Errorf("expected value 42, got %f", s.value)
+		}
+		if s.timestamp < before {
+			t.Errorf("expected the sample to be timestamped at collection, got %d", s.timestamp)
+		}
+	}
+	if !found {
+		t.Fatal("expected the remaining pulls to be written")
+	}
+	for _, name := range []string{"dockerhub_pull_auth_failures_total", "dockerhub_pull_anonymous_fallbacks_total"} {
+		if !names[name] {
+			t.Errorf("expected %s to be written", name)
+		}
+	}
+	if len(writer.queue) != 0 {
+		t.Errorf("expected the queue to be empty, got %d samples", len(writer.queue))
+	}
+}
+
+func TestRemoteWriterQueuesDuringOutage(t *testing.T) {
+	receiver := &fakeRemoteWriteReceiver{status: http.StatusServiceUnavailable}
+	writer := newTestRemoteWriter(t, receiver, remoteWriteConfig{MaxRetries: 2})
+
+	pullRemaining.WithLabelValues("remote-write-user", "192.0.2.1", "dockerhub", "").Set(42)
+	writer.enqueue()
+	queued := len(writer.queue)
+	writer.flush()
+	if len(receiver.auth) != 3 {
+		t.Errorf("expected 3 attempts, got %d", len(receiver.auth))
+	}
+	if len(writer.queue) != queued {
+		t.Fatalf("expected %d samples to stay queued, got %d", queued, len(writer.queue))
+	}
+
+	receiver.setStatus(http.StatusOK)
+	writer.flush()
+	if len(writer.queue) != 0 {
+		t.Errorf("expected the queue to be empty after recovering, got %d samples", len(writer.queue))
+	}
+	if len(receiver.received()) != queued {
+		t.Errorf("expected %d samples to be received, got %d", queued, len(receiver.received()))
+	}
+}
+
+func TestRemoteWriterDropsRejectedSamples(t *testing.T) {
+	receiver := &fakeRemoteWriteReceiver{status: http.StatusBadRequest}
+	writer := newTestRemoteWriter(t, receiver, remoteWriteConfig{})
+
+	pullRemaining.WithLabelValues("remote-write-user", "192.0.2.1", "dockerhub", "").Set(42)
+	writer.enqueue()
+	writer.flush()
+	if len(receiver.auth) != 1 {
+		t.Errorf("expected rejected samples not to be retried, got %d attempts", len(receiver.auth))
+	}
+	if len(writer.queue) != 0 {
+		t.Errorf("expected rejected samples to be dropped, got %d samples", len(writer.queue))
+	}
+}
+
+func TestRemoteWriterQueueCapacity(t *testing.T) {
+	receiver := &fakeRemoteWriteReceiver{status: http.StatusOK}
+	writer := newTestRemoteWriter(t, receiver, remoteWriteConfig{QueueCapacity: 1})
+
+	pullRemaining.WithLabelValues("remote-write-user", "192.0.2.1", "dockerhub", "").Set(42)
+	writer.enqueue()
+	writer.enqueue()
+	if len(writer.queue) != 1 {
+		t.Errorf("expected the queue to be capped at 1 sample, got %d", len(writer.queue))
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type schedulerConfig struct {
+	// Workers caps the number of probes running at the same time.
+	Workers int `yaml:"workers"`
+	// Jitter is the maximum random delay added to every scheduled probe.
+	Jitter time.Duration `yaml:"jitter"`
+}
+
+// scheduledCredential is the schedule of a single credential. running is set
+// from the moment a probe is dispatched until it finishes.
+type scheduledCredential struct {
+	credential credentials
+	// account is the account label of the credential, which for anonymous
+	// credentials without an alias is only known after the first collection.
+	account  atomic.Value
+	running  atomic.Bool
+	interval atomic.Int64
+	// changed is signalled when the interval is updated
+	changed chan struct{}
+}
+
+func (e *scheduledCredential) getInterval() time.Duration {
+	return time.Duration(e.interval.Load())
+}
+
+func (e *scheduledCredential) getAccount() string {
+	return e.account.Load().(string)
+}
+
+// setAccount updates the account label of the entry, moving its poll interval
+// to the new label.
+func (e *scheduledCredential) setAccount(account string) {
+	previous := e.account.Swap(account)
+	if previous == account {
+		return
+	}
+	if previous != nil {
+		pollIntervalSeconds.DeleteLabelValues(previous.(string), e.credential.registry())
+	}
+	pollIntervalSeconds.WithLabelValues(account, e.credential.registry()).Set(e.getInterval().Seconds())
+}
+
+func (e *scheduledCredential) setInterval(interval time.Duration) {
+	if e.interval.Swap(int64(interval)) == int64(interval) {
+		return
+	}
+	pollIntervalSeconds.WithLabelValues(e.getAccount(), e.credential.registry()).Set(interval.Seconds())
+	select {
+	case e.changed <- struct{}{}:
+	default:
+	}
+}
+
+type scheduledProbe struct {
+	entry     *scheduledCredential
+	scheduled time.Time
+}
+
+// scheduler spreads the probes of every credential across the update interval
+// instead of firing them all at once, and runs them on a bounded pool of
+// workers. A tick is skipped when the previous probe of the same credential is
+// still queued or running.
+type scheduler struct {
+	config       configuration
+	afterCollect collectHook
+	// afterCycle runs once every credential has been probed since it last ran.
+	afterCycle func()
+	workers    int
+	jitter     time.Duration
+	entries    []*scheduledCredential
+	probes     chan scheduledProbe
+
+	cycleMutex sync.Mutex
+	probed     map[*scheduledCredential]bool
+}
+
+func newScheduler(config configuration, afterCollect collectHook, afterCycle func()) *scheduler {
+	workers := config.Scheduler.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+	jitter := config.Scheduler.Jitter
+	if jitter == 0 {
+		jitter = config.UpdateInterval / 10
+	}
+
+	s := &scheduler{
+		config:       config,
+		afterCollect: afterCollect,
+		afterCycle:   afterCycle,
+		workers:      workers,
+		jitter:       jitter,
+		// Every credential has at most one probe queued, so dispatching never blocks.
+		probes: make(chan scheduledProbe, len(config.Credentials)),
+		probed: map[*scheduledCredential]bool{},
+	}
+	for _, credential := range config.Credentials {
+		entry := &scheduledCredential{credential: credential, changed: make(chan struct{}, 1)}
+		entry.interval.Store(int64(config.UpdateInterval))
+		entry.setAccount(accountName(credential, config.AnonymousAlias, ""))
+		s.entries = append(s.entries, entry)
+	}
+	return s
+}
+
+// run starts the workers and the schedule of every credential until ctx is done.
+func (s *scheduler) run(ctx context.Context) {
+	for range s.workers {
+		go s.work(ctx)
+	}
+
+	start := time.Now()
+	for i, entry := range s.entries {
+		log.WithFields(log.Fields{
+			"username": entry.credential.Username,
+		}).Info("Starting metrics collector")
+		offset := s.config.UpdateInterval * time.Duration(i) / time.Duration(len(s.entries))
+		go s.schedule(ctx, entry, start.Add(offset))
+	}
+}
+
+// schedule dispatches a probe for the entry every interval, starting at first.
+// When the interval changes, the pending probe is rescheduled right away.
+func (s *scheduler) schedule(ctx context.Context, entry *scheduledCredential, first time.Time) {
+	var previous time.Time
+	next := first
+	for {
+		due := next
+		if s.jitter > 0 {
+			due = due.Add(rand.N(s.jitter))
+		}
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-entry.changed:
+			timer.Stop()
+			if !previous.IsZero() {
+				next = previous.Add(entry.getInterval())
+			}
+		case <-timer.C:
+			s.dispatch(entry, due)
+			previous = next
+			next = next.Add(entry.getInterval())
+		}
+	}
+}
+
+func (s *scheduler) dispatch(entry *scheduledCredential, scheduled time.Time) {
+	if !entry.running.CompareAndSwap(false, true) {
+		log.WithFields(log.Fields{
+			"username": entry.credential.Username,
+		}).Warn("Skipping probe, the previous one is still running")
+		schedulerSkipped.WithLabelValues(entry.getAccount(), entry.credential.registry()).Inc()
+		return
+	}
+	s.probes <- scheduledProbe{entry: entry, scheduled: scheduled}
+}
+
+// adapt updates the interval of the entry from its latest reading.
+func (s *scheduler) adapt(entry *scheduledCredential, l limits) {
+	estimate, ok := consumption.lastEstimate(accountKey(l.registry, entry.getAccount()))
+	if !ok {
+		return
+	}
+	entry.setInterval(adaptiveInterval(s.config.AdaptivePolling, l, estimate))
+}
+
+func (s *scheduler) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case probe := <-s.probes:
+			schedulerLag.Observe(time.Since(probe.scheduled).Seconds())
+			schedulerRunning.Inc()
+			l, err := collect(probe.entry.credential, s.config)
+			s.afterCollect(probe.entry.credential, l, err)
+			if err == nil {
+				probe.entry.setAccount(accountName(probe.entry.credential, s.config.AnonymousAlias, l.source))
+			}
+			if err == nil && s.config.AdaptivePolling.Enabled {
+				s.adapt(probe.entry, l)
+			}
+			schedulerRunning.Dec()
+			probe.entry.running.Store(false)
+			s.completeCycle(probe.entry)
+		}
+	}
+}
+
+// completeCycle records that the entry was probed, and runs afterCycle once
+// every credential has been probed, whether the probes succeeded or not.
+// Credentials polled more often by adaptive polling count once per cycle.
+func (s *scheduler) completeCycle(entry *scheduledCredential) {
+	s.cycleMutex.Lock()
+	s.probed[entry] = true
+	done := len(s.probed) == len(s.entries)
+	if done {
+		s.probed = map[*scheduledCredential]bool{}
+	}
+	s.cycleMutex.Unlock()
+	if done && s.afterCycle != nil {
+		s.afterCycle()
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSchedulerBoundsConcurrency(t *testing.T) {
+	hub := newFakeDockerHub(t, "100;w=21600", "42;w=21600")
+	hub.delay = 50 * time.Millisecond
+
+	var creds []credentials
+	for i := range 6 {
+		creds = append(creds, credentials{Username: fmt.Sprintf("scheduled%d", i), Password: "password"})
+	}
+	config := configuration{
+		Credentials:    creds,
+		UpdateInterval: time.Hour,
+		Timeout:        time.Second,
+		Scheduler:      schedulerConfig{Workers: 2, Jitter: time.Nanosecond},
+	}
+
+	var mutex sync.Mutex
+	collected := map[string]int{}
+	s := newScheduler(config, func(credential credentials, _ limits, err error) {
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		collected[credential.Username]++
+	}, nil)
+	for _, entry := range s.entries {
+		s.dispatch(entry, time.Now())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for range s.workers {
+		go s.work(ctx)
+	}
+	waitFor(t, 2*time.Second, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(collected) == len(creds)
+	})
+	if got := hub.maxInFlight.Load(); got > 2 {
+		t.Errorf("expected at most 2 concurrent probes, got %d", got)
+	}
+}
+
+func TestSchedulerSpreadsFirstProbes(t *testing.T) {
+	newFakeDockerHub(t, "100;w=21600", "42;w=21600")
+	config := configuration{
+		Credentials: []credentials{
+			{Username: "spread0", Password: "password"},
+			{Username: "spread1", Password: "password"},
+			{Username: "spread2", Password: "password"},
+		},
+		UpdateInterval: 300 * time.Millisecond,
+		Timeout:        time.Second,
+		Scheduler:      schedulerConfig{Workers: 3, Jitter: time.Nanosecond},
+	}
+
+	var mutex sync.Mutex
+	times := map[string]time.Time{}
+	s := newScheduler(config, func(credential credentials, _ limits, _ error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if _, ok := times[credential.Username]; !ok {
+			times[credential.Username] = time.Now()
+		}
+	}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	s.run(ctx)
+
+	waitFor(t, time.Second, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(times) == 3
+	})
+	mutex.Lock()
+	defer mutex.Unlock()
+	if times["spread2"].Sub(start) < 200*time.Millisecond {
+		t.Errorf("expected the last credential to be probed two thirds into the interval, got %v", times["spread2"].Sub(start))
+	}
+	if times["spread0"].Sub(start) > 100*time.Millisecond {
+		t.Errorf("expected the first credential to be probed right away, got %v", times["spread0"].Sub(start))
+	}
+}
+
+func TestSchedulerRunsAfterCycleOncePerCycle(t *testing.T) {
+	s := newScheduler(configuration{
+		Credentials: []credentials{
+			{Username: "cycle0", Password: "password"},
+			{Username: "cycle1", Password: "password"},
+		},
+		UpdateInterval: time.Minute,
+	}, func(credentials, limits, error) {}, nil)
+	cycles := 0
+	s.afterCycle = func() { cycles++ }
+
+	// A credential probed twice within a cycle doesn't end it.
+	s.completeCycle(s.entries[0])
+	s.completeCycle(s.entries[0])
+	if cycles != 0 {
+		t.Fatalf("expected no cycle before every credential is probed, got %d", cycles)
+	}
+	s.completeCycle(s.entries[1])
+	if cycles != 1 {
+		t.Fatalf("expected 1 cycle, got %d", cycles)
+	}
+	s.completeCycle(s.entries[1])
+	s.completeCycle(s.entries[0])
+	if cycles != 2 {
+		t.Fatalf("expected 2 cycles, got %d", cycles)
+	}
+}
+
+func TestSchedulerSkipsRunningProbes(t *testing.T) {
+	s := newScheduler(configuration{
+		Credentials:    []credentials{{Username: "busy", Password: "password"}},
+		UpdateInterval: time.Minute,
+	}, func(credentials, limits, error) {}, nil)
+	entry := s.entries[0]
+	skipped := testutil.ToFloat64(schedulerSkipped.WithLabelValues("busy", "dockerhub"))
+
+	s.dispatch(entry, time.Now())
+	s.dispatch(entry, time.Now())
+	if got := testutil.ToFloat64(schedulerSkipped.WithLabelValues("busy", "dockerhub")) - skipped; got != 1 {
+		t.Errorf("expected 1 skipped probe, got %f", got)
+	}
+	if len(s.probes) != 1 {
+		t.Errorf("expected 1 queued probe, got %d", len(s.probes))
+	}
+}
+
+func TestSchedulerLabelsAnonymousCredentials(t *testing.T) {
+	s := newScheduler(configuration{
+		Credentials:    []credentials{{Anonymous: true}},
+		UpdateInterval: time.Minute,
+	}, func(credentials, limits, error) {}, nil)
+	entry := s.entries[0]
+	if got := testutil.ToFloat64(pollIntervalSeconds.WithLabelValues("anonymous", "dockerhub")); got != 60 {
+		t.Errorf("expected the interval of the anonymous account before its source is known, got %f", got)
+	}
+
+	entry.setAccount(accountName(entry.credential, "", "192.0.2.1"))
+	if got := testutil.ToFloat64(pollIntervalSeconds.WithLabelValues("192.0.2.1", "dockerhub")); got != 60 {
+		t.Errorf("expected the interval to be labelled with the source, got %f", got)
+	}
+	if pollIntervalSeconds.DeleteLabelValues("anonymous", "dockerhub") {
+		t.Error("expected the interval labelled before the source was known to be removed")
+	}
+
+	skipped := testutil.ToFloat64(schedulerSkipped.WithLabelValues("192.0.2.1", "dockerhub"))
+	s.dispatch(entry, time.Now())
+	s.dispatch(entry, time.Now())
+	if got := testutil.ToFloat64(schedulerSkipped.WithLabelValues("192.0.2.1", "dockerhub")) - skipped; got != 1 {
+		t.Errorf("expected 1 skipped probe, got %f", got)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// accountState is the last known reading of an account as persisted in the
+// state file.
+type accountState struct {
+	Account         string        `json:"account"`
+	Source          string        `json:"source"`
+	Registry        string        `json:"registry,omitempty"`
+	Policy          string        `json:"policy,omitempty"`
+	Unlimited       bool          `json:"unlimited,omitempty"`
+	UserID          string        `json:"user_id,omitempty"`
+	Limit           int           `json:"limit"`
+	Remaining       int           `json:"remaining"`
+	LimitWindow     int           `json:"limit_window"`
+	RemainingWindow int           `json:"remaining_window"`
+	Reset           int           `json:"reset,omitempty"`
+	Windows         []windowState `json:"windows,omitempty"`
+	CollectedAt     time.Time     `json:"collected_at"`
+	History         []sample      `json:"history,omitempty"`
+}
+
+// windowState is a rate limit policy of an account as persisted in the state
+// file.
+type windowState struct {
+	Policy    string `json:"policy"`
+	Window    int    `json:"window"`
+	Limit     int    `json:"limit"`
+	Remaining int    `json:"remaining"`
+}
+
+func (a accountState) limits() limits {
+	l := limits{
+		limit:           a.Limit,
+		remaining:       a.Remaining,
+		limitWindow:     a.LimitWindow,
+		remainingWindow: a.RemainingWindow,
+		reset:           a.Reset,
+		source:          a.Source,
+		registry:        a.registry(),
+		policy:          a.Policy,
+		unlimited:       a.Unlimited,
+		userID:          a.UserID,
+	}
+	for _, w := range a.Windows {
+		l.windows = append(l.windows, windowLimits{policy: w.Policy, window: w.Window, limit: w.Limit, remaining: w.Remaining})
+	}
+	return l
+}
+
+// registry returns the registry of the account. State files written before
+// other registries were supported only hold Docker Hub accounts.
+func (a accountState) registry() string {
+	if a.Registry == "" {
+		return dockerHubRegistry
+	}
+	return a.Registry
+}
+
+type stateStore struct {
+	mutex    sync.Mutex
+	accounts map[string]accountState
+}
+
+func newStateStore() *stateStore {
+	return &stateStore{accounts: map[string]accountState{}}
+}
+
+var state = newStateStore()
+
+func (s *stateStore) record(account string, l limits, collectedAt time.Time) {
+	reading := accountState{
+		Account:         account,
+		Source:          l.source,
+		Registry:        l.registry,
+		Policy:          l.policy,
+		Unlimited:       l.unlimited,
+		UserID:          l.userID,
+		Limit:           l.limit,
+		Remaining:       l.remaining,
+		LimitWindow:     l.limitWindow,
+		RemainingWindow: l.remainingWindow,
+		Reset:           l.reset,
+		CollectedAt:     collectedAt,
+	}
+	for _, w := range l.windows {
+		reading.Windows = append(reading.Windows, windowState{Policy: w.policy, Window: w.window, Limit: w.limit, Remaining: w.remaining})
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.accounts[accountKey(reading.registry(), account)] = reading
+}
+
+// get returns the last reading of the account with key.
+func (s *stateStore) get(key string) (accountState, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	reading, ok := s.accounts[key]
+	return reading, ok
+}
+
+// snapshot returns the last reading of every account sorted by account name,
+// together with its consumption history.
+func (s *stateStore) snapshot() []accountState {
+	s.mutex.Lock()
+	accounts := make([]accountState, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		accounts = append(accounts, account)
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(accounts, func(i, j int) bool {
+		if accounts[i].Account != accounts[j].Account {
+			return accounts[i].Account < accounts[j].Account
+		}
+		return accounts[i].Registry < accounts[j].Registry
+	})
+	for i := range accounts {
+		accounts[i].History = consumption.samples(accountKey(accounts[i].registry(), accounts[i].Account))
+	}
+	return accounts
+}
+
+// saveState writes the accounts to path atomically, so a crash while writing
+// never leaves a truncated state file behind.
+func saveState(path string, accounts []accountState) error {
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := os.Remove(tmp.Name())
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Error removing temporary state file: %v", err)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func loadState(path string) ([]accountState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var accounts []accountState
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// restoreState exports the readings loaded from the state file and restores
+// the consumption history. The readings keep their original collection time so
+// their age can be told apart from fresh ones.
+func restoreState(accounts []accountState) {
+	for _, account := range accounts {
+		l := account.limits()
+		state.record(account.Account, l, account.CollectedAt)
+		consumption.restore(accountKey(l.registry, account.Account), account.History)
+		setLimitMetrics(account.Account, l, account.CollectedAt)
+	}
+}
+
+// restoreStateFile restores the state file if it exists.
+func restoreStateFile(path string) {
+	accounts, err := loadState(path)
+	if err == nil {
+		log.WithFields(log.Fields{
+			"accounts": len(accounts),
+		}).Info("Restored state from state file")
+		restoreState(accounts)
+	} else if !os.IsNotExist(err) {
+		log.Errorf("Failed to load state file %s: %v", path, err)
+	}
+}
+
+// startStateWriter restores the state file and then saves the current state to
+// it every interval.
+func startStateWriter(path string, interval time.Duration) {
+	restoreStateFile(path)
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			if err := saveState(path, state.snapshot()); err != nil {
+				log.Errorf("Failed to save state file %s: %v", path, err)
+			}
+		}
+	}()
+}
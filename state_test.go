@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSaveAndLoadState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	collectedAt := time.Unix(1700000000, 0).UTC()
+	accounts := []accountState{
+		{
+			Account:         "user1",
+			Source:          "192.0.2.1",
+			Limit:           100,
+			Remaining:       42,
+			LimitWindow:     21600,
+			RemainingWindow: 21600,
+			Reset:           3600,
+			Windows: []windowState{
+				{Policy: "hourly", Window: 3600, Limit: 100, Remaining: 42},
+				{Policy: "daily", Window: 86400, Limit: 1000, Remaining: 500},
+			},
+			CollectedAt: collectedAt,
+			History: []sample{
+				{Time: collectedAt.Add(-time.Minute), Remaining: 43},
+				{Time: collectedAt, Remaining: 42},
+			},
+		},
+	}
+
+	if err := saveState(path, accounts); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(loaded, accounts) {
+		t.Fatalf("expected %+v, got %+v", accounts, loaded)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the state file to be left behind, got %d files", len(entries))
+	}
+}
+
+func TestLoadStateCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`[{"account":`), 0600); err != nil {
+		t.Fatalf("failed to write state file: %v", err)
+	}
+	if _, err := loadState(path); err == nil {
+		t.Fatal("expected error for corrupted state file, got nil")
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	collectedAt := time.Unix(1700000000, 0)
+	restoreState([]accountState{
+		{
+			Account:         "restored",
+			Source:          "192.0.2.1",
+			Limit:           100,
+			Remaining:       42,
+			LimitWindow:     21600,
+			RemainingWindow: 21600,
+			Windows:         []windowState{{Policy: "hourly", Window: 3600, Limit: 100, Remaining: 42}},
+			CollectedAt:     collectedAt,
+			History:         []sample{{Time: collectedAt, Remaining: 42}},
+		},
+	})
+
+	if got := testutil.ToFloat64(pullRemaining.WithLabelValues("restored", "192.0.2.1", "dockerhub", "")); got != 42 {
+		t.Errorf("expected restored remaining to be 42, got %f", got)
+	}
+	if got := testutil.ToFloat64(lastSuccessTimestamp.WithLabelValues("restored", "192.0.2.1", "dockerhub", "")); got != 1700000000 {
+		t.Errorf("expected restored timestamp to be 1700000000, got %f", got)
+	}
+	if got := testutil.ToFloat64(windowRemaining.WithLabelValues("restored", "192.0.2.1", "dockerhub", "hourly", "3600")); got != 42 {
+		t.Errorf("expected restored window remaining to be 42, got %f", got)
+	}
+	if got := len(consumption.samples("dockerhub/restored")); got != 1 {
+		t.Errorf("expected restored history to have 1 sample, got %d", got)
+	}
+}